@@ -3,6 +3,7 @@ package config
 import (
 	"log"
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +13,8 @@ var (
 )
 
 type Message struct {
+	// frame type of outbound messages: text, binary or mixed, with mixed both are accepted,
+	// replies use the frame type of the request and other messages are sent as binary
 	Format string `yaml:"format"`
 	Endian string `yaml:"endian"`
 }
@@ -19,11 +22,16 @@ type Message struct {
 type TLV struct {
 	Type   bool `yaml:"type"`
 	Length bool `yaml:"length"`
+
+	// carry sequence number in the header, it's required by reliable messages
+	Seq bool `yaml:"seq"`
 }
 
 type Distribute struct {
-	Status bool   `yaml:"status"`
-	Way    string `yaml:"way"`
+	Status        bool   `yaml:"status"`
+	Way           string `yaml:"way"`
+	StatsInterval uint32 `yaml:"stats_interval"`
+	LeaderLease   uint32 `yaml:"leader_lease"`
 }
 
 type Redis struct {
@@ -32,6 +40,8 @@ type Redis struct {
 	DB             int    `yaml:"db"`
 	WorldChannel   string `yaml:"world_channel"`
 	ForwardChannel string `yaml:"forward_channel"`
+	StatsKey       string `yaml:"stats_key"`
+	AuditChannel   string `yaml:"audit_channel"`
 }
 
 type Framework struct {
@@ -41,12 +51,149 @@ type Framework struct {
 	MaxPackageSize   uint32 `yaml:"max_package_size"`
 }
 
+type Connection struct {
+	// capacity of each priority lane of connection's outbound queue, it's at least 1
+	SendQueueSize int `yaml:"send_queue_size"`
+
+	// what to do when the outbound queue is full: block, drop_newest, drop_oldest or disconnect
+	SendPolicy string `yaml:"send_policy"`
+
+	// how long a sender waits with block policy, 0 means wait until the connection closed
+	SendTimeout time.Duration `yaml:"send_timeout"`
+
+	// answer application level heartbeat messages, it requires tlv type enabled and a non-zero heartbeat data type
+	Heartbeat bool `yaml:"heartbeat"`
+
+	// data type of heartbeat messages, they are echoed back instead of routed to handlers
+	HeartbeatDataType uint32 `yaml:"heartbeat_data_type"`
+
+	// subprotocols supported by server in order of preference
+	Subprotocols []string `yaml:"subprotocols"`
+
+	// IPs or CIDRs of proxies whose X-Forwarded-For header is trusted
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// close connections which haven't sent application messages for this long, 0 means never
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	// close connections which have been open for this long, so clients have to authenticate again,
+	// 0 means never
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+}
+
+type Compression struct {
+	// negotiate permessage-deflate with clients
+	Status bool `yaml:"status"`
+
+	// flate compression level, from -2 to 9
+	Level int `yaml:"level"`
+
+	// messages shorter than this are sent without compression
+	Threshold int `yaml:"threshold"`
+}
+
+type RateLimit struct {
+	Status bool `yaml:"status"`
+
+	// inbound messages per second of each connection, 0 means no limit
+	Messages float64 `yaml:"messages"`
+
+	// inbound bytes per second of each connection, 0 means no limit
+	Bytes float64 `yaml:"bytes"`
+
+	// inbound messages per second of each connection by data type
+	DataTypes map[uint32]float64 `yaml:"data_types"`
+
+	// how many seconds of tokens a bucket could save for bursts
+	Burst float64 `yaml:"burst"`
+
+	// what to do when limit exceeded: drop, delay, error or disconnect
+	Policy string `yaml:"policy"`
+
+	// data type of the message sent to client with error policy, it requires tlv type enabled
+	// and must be non-zero, or messages are dropped without error
+	ErrorDataType uint32 `yaml:"error_data_type"`
+}
+
+type Session struct {
+	// issue resume tokens and keep sessions of dropped connections, it requires tlv type enabled
+	// and a non-zero token data type
+	Status bool `yaml:"status"`
+
+	// how long a session is kept after its connection dropped
+	GracePeriod time.Duration `yaml:"grace_period"`
+
+	// data type of the message carrying resume token sent on open
+	TokenDataType uint32 `yaml:"token_data_type"`
+
+	// query parameter carrying resume token of the upgrade request
+	ResumeParam string `yaml:"resume_param"`
+
+	// maximum outbound messages buffered while detached, the oldest are dropped beyond it
+	BufferSize int `yaml:"buffer_size"`
+}
+
+type Reliable struct {
+	// deliver messages sent by SendReliable at least once, it requires session and tlv seq enabled
+	// and a non-zero ack data type, as unacknowledged messages are retransmitted on resuming
+	Status bool `yaml:"status"`
+
+	// data type of acknowledgement messages from client, the seq field carries
+	// the highest sequence number received in order
+	AckDataType uint32 `yaml:"ack_data_type"`
+
+	// maximum unacknowledged messages kept of each connection
+	RetentionSize int `yaml:"retention_size"`
+
+	// unacknowledged messages older than this are discarded, 0 means never
+	RetentionTime time.Duration `yaml:"retention_time"`
+}
+
+type Sampling struct {
+	// log the first n entries with the same message in each tick
+	Initial int `yaml:"initial"`
+
+	// then log every nth entry in the same tick
+	Thereafter int `yaml:"thereafter"`
+
+	Tick time.Duration `yaml:"tick"`
+}
+
+type Log struct {
+	// log file path, logs are only written to stderr if it's empty
+	File string `yaml:"file"`
+
+	// rotate the file once it's beyond this size in megabytes, 0 means no limit
+	MaxSize int `yaml:"max_size"`
+
+	// rotate the file periodically, such as 1h or 24h, 0 means never
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+
+	// maximum number of rotated files to keep, 0 means keep all
+	MaxBackups int `yaml:"max_backups"`
+
+	// maximum days to keep rotated files, 0 means keep forever
+	MaxAge int `yaml:"max_age"`
+
+	// compress rotated files with gzip
+	Compress bool `yaml:"compress"`
+
+	// sampling of per message logs, it's disabled if initial is 0
+	Sampling `yaml:"sampling"`
+}
+
 type GlobalConfig struct {
-	Framework  `yaml:"framework"`
-	Message    `yaml:"message"`
-	TLV        `yaml:"tlv"`
-	Distribute `yaml:"distribute"`
-	Redis      `yaml:"redis"`
+	Framework   `yaml:"framework"`
+	Message     `yaml:"message"`
+	TLV         `yaml:"tlv"`
+	Distribute  `yaml:"distribute"`
+	Redis       `yaml:"redis"`
+	Log         `yaml:"log"`
+	Connection  `yaml:"connection"`
+	Compression `yaml:"compression"`
+	RateLimit   `yaml:"rate_limit"`
+	Session     `yaml:"session"`
+	Reliable    `yaml:"reliable"`
 }
 
 func init() {
@@ -69,8 +216,10 @@ func loadConfigFile() {
 			Length: false,
 		},
 		Distribute: Distribute{
-			Status: false,
-			Way:    "redis",
+			Status:        false,
+			Way:           "redis",
+			StatsInterval: 5,
+			LeaderLease:   15,
 		},
 		Redis: Redis{
 			Addr:           "localhost:6379:",
@@ -78,6 +227,43 @@ func loadConfigFile() {
 			DB:             0,
 			WorldChannel:   "world_channel",
 			ForwardChannel: "forward_channel",
+			StatsKey:       "homey_stats",
+			AuditChannel:   "audit_channel",
+		},
+		Connection: Connection{
+			SendQueueSize: 256,
+			SendPolicy:    "block",
+			SendTimeout:   5 * time.Second,
+		},
+		Compression: Compression{
+			Status:    false,
+			Level:     1,
+			Threshold: 256,
+		},
+		RateLimit: RateLimit{
+			Status: false,
+			Burst:  1,
+			Policy: "drop",
+		},
+		Reliable: Reliable{
+			Status:        false,
+			RetentionSize: 1024,
+			RetentionTime: 5 * time.Minute,
+		},
+		Session: Session{
+			Status:      false,
+			GracePeriod: time.Minute,
+			ResumeParam: "resume_token",
+			BufferSize:  256,
+		},
+		Log: Log{
+			File:    "",
+			MaxSize: 100,
+			Sampling: Sampling{
+				Initial:    100,
+				Thereafter: 100,
+				Tick:       time.Second,
+			},
 		},
 	}
 
@@ -0,0 +1,237 @@
+package distribute
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	// the lease used if ttl given to NewLeaderElector is too short
+	DefaultLeaderLease = 15 * time.Second
+
+	// the lease is renewed every third of ttl, and redis expires keys in milliseconds
+	minLeaderLease = 3 * time.Millisecond
+)
+
+type (
+	// LeaseStore keeps an exclusive lease of a key, it's the primitive of leader election
+	LeaseStore interface {
+		// try to acquire the lease, ok is false if it's held by others
+		Acquire(ctx context.Context, key, holder string, ttl time.Duration) (ok bool, err error)
+
+		// extend the lease, ok is false if it isn't held by holder any more
+		Renew(ctx context.Context, key, holder string, ttl time.Duration) (ok bool, err error)
+
+		// give up the lease if it's held by holder
+		Release(ctx context.Context, key, holder string) error
+	}
+
+	redisLeaseStore struct {
+		client *redis.Client
+	}
+
+	memoryLease struct {
+		holder string
+
+		expireAt time.Time
+	}
+
+	memoryLeaseStore struct {
+		leases map[string]memoryLease
+
+		lock sync.Mutex
+	}
+
+	// LeaderElector makes sure only one holder runs as leader of a key at the same time
+	LeaderElector struct {
+		store LeaseStore
+
+		key string
+
+		holder string
+
+		ttl time.Duration
+
+		// called on gaining leadership, ctx is cancelled once leadership is lost
+		onElected func(ctx context.Context)
+
+		// called on losing leadership
+		onRevoked func()
+
+		logger *zap.Logger
+
+		isLeader atomic.Bool
+	}
+)
+
+var (
+	renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+	releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+func (rs *redisLeaseStore) Acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	return rs.client.SetNX(ctx, key, holder, ttl).Result()
+}
+
+func (rs *redisLeaseStore) Renew(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	result, err := renewScript.Run(ctx, rs.client, []string{key}, holder, ttl.Milliseconds()).Int()
+	return result == 1, err
+}
+
+func (rs *redisLeaseStore) Release(ctx context.Context, key, holder string) error {
+	return releaseScript.Run(ctx, rs.client, []string{key}, holder).Err()
+}
+
+func (ms *memoryLeaseStore) Acquire(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if lease, ok := ms.leases[key]; ok && time.Now().Before(lease.expireAt) {
+		return false, nil
+	}
+
+	ms.leases[key] = memoryLease{holder: holder, expireAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (ms *memoryLeaseStore) Renew(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	lease, ok := ms.leases[key]
+	if !ok || lease.holder != holder || time.Now().After(lease.expireAt) {
+		return false, nil
+	}
+
+	lease.expireAt = time.Now().Add(ttl)
+	ms.leases[key] = lease
+	return true, nil
+}
+
+func (ms *memoryLeaseStore) Release(ctx context.Context, key, holder string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if lease, ok := ms.leases[key]; ok && lease.holder == holder {
+		delete(ms.leases, key)
+	}
+
+	return nil
+}
+
+// NewRedisLeaseStore returns a lease store based on redis SET NX
+func NewRedisLeaseStore() LeaseStore {
+	return &redisLeaseStore{client: redisClient}
+}
+
+// NewMemoryLeaseStore returns a lease store which only works inside current process
+func NewMemoryLeaseStore() LeaseStore {
+	return &memoryLeaseStore{
+		leases: make(map[string]memoryLease),
+	}
+}
+
+func (le *LeaderElector) SetLogger(logger *zap.Logger) {
+	le.logger = logger
+}
+
+func (le *LeaderElector) IsLeader() bool {
+	return le.isLeader.Load()
+}
+
+func (le *LeaderElector) becomeLeader(ctx context.Context) context.CancelFunc {
+	leaderCtx, cancel := context.WithCancel(ctx)
+	le.isLeader.Store(true)
+	le.logger.Info("leadership gained", zap.String("key", le.key), zap.String("holder", le.holder))
+	if le.onElected != nil {
+		go le.onElected(leaderCtx)
+	}
+
+	return cancel
+}
+
+// Run campaigns for leadership and renews the lease until ctx is done,
+// leadership is released before it returns
+func (le *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(le.ttl / 3)
+	defer ticker.Stop()
+
+	var cancelLeader context.CancelFunc
+	stepDown := func() {
+		if !le.isLeader.Swap(false) {
+			return
+		}
+
+		cancelLeader()
+		le.logger.Info("leadership lost", zap.String("key", le.key), zap.String("holder", le.holder))
+		if le.onRevoked != nil {
+			le.onRevoked()
+		}
+	}
+
+	for {
+		if le.IsLeader() {
+			ok, err := le.store.Renew(ctx, le.key, le.holder, le.ttl)
+			if err != nil {
+				le.logger.Error("failed to renew leader lease", zap.String("key", le.key), zap.String("error", err.Error()))
+			}
+
+			if !ok {
+				stepDown()
+			}
+		} else {
+			ok, err := le.store.Acquire(ctx, le.key, le.holder, le.ttl)
+			if err != nil {
+				le.logger.Error("failed to acquire leader lease", zap.String("key", le.key), zap.String("error", err.Error()))
+			}
+
+			if ok {
+				cancelLeader = le.becomeLeader(ctx)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if le.IsLeader() {
+				if err := le.store.Release(context.Background(), le.key, le.holder); err != nil {
+					le.logger.Error("failed to release leader lease", zap.String("key", le.key), zap.String("error", err.Error()))
+				}
+			}
+			stepDown()
+			return
+		}
+	}
+}
+
+// NewLeaderElector creates an elector holding the lease of key for ttl, DefaultLeaderLease is used
+// if ttl is shorter than 3ms
+func NewLeaderElector(store LeaseStore, key, holder string, ttl time.Duration, onElected func(context.Context), onRevoked func()) *LeaderElector {
+	if ttl < minLeaderLease {
+		ttl = DefaultLeaderLease
+	}
+
+	return &LeaderElector{
+		store:     store,
+		key:       key,
+		holder:    holder,
+		ttl:       ttl,
+		onElected: onElected,
+		onRevoked: onRevoked,
+		logger:    zap.NewNop(),
+	}
+}
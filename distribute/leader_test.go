@@ -0,0 +1,61 @@
+package distribute
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaderElection(t *testing.T) {
+	store := NewMemoryLeaseStore()
+	ttl := 30 * time.Millisecond
+
+	elected := make(chan string, 2)
+	revoked := make(chan string, 2)
+	newElector := func(holder string) *LeaderElector {
+		return NewLeaderElector(store, "job", holder, ttl,
+			func(ctx context.Context) { elected <- holder },
+			func() { revoked <- holder })
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	first := newElector("first")
+	go first.Run(ctx1)
+
+	if holder := <-elected; holder != "first" {
+		t.Fatalf("expected first to be elected, but %s got", holder)
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	second := newElector("second")
+	go second.Run(ctx2)
+
+	time.Sleep(3 * ttl)
+	if second.IsLeader() {
+		t.Fatal("expected second not to be leader while first holds the lease")
+	}
+
+	cancel1()
+	if holder := <-revoked; holder != "first" {
+		t.Fatalf("expected first to be revoked, but %s got", holder)
+	}
+
+	select {
+	case holder := <-elected:
+		if holder != "second" {
+			t.Fatalf("expected second to be elected, but %s got", holder)
+		}
+	case <-time.After(10 * ttl):
+		t.Fatal("second wasn't elected after first released leadership")
+	}
+}
+
+func TestLeaderElectorDefaultLease(t *testing.T) {
+	for _, ttl := range []time.Duration{0, time.Nanosecond, -time.Second} {
+		elector := NewLeaderElector(NewMemoryLeaseStore(), "job", "node", ttl, nil, nil)
+		if elector.ttl != DefaultLeaderLease {
+			t.Errorf("expected ttl %v for %v, but %v got", DefaultLeaderLease, ttl, elector.ttl)
+		}
+	}
+}
@@ -3,37 +3,36 @@ package distribute
 import (
 	"context"
 	"encoding/base64"
-	"os"
-
-	log "github.com/towerman1990/homey/logger"
+	"strconv"
 
 	"github.com/go-redis/redis/v9"
 	"github.com/towerman1990/homey/config"
-	"go.uber.org/zap"
 )
 
 var (
 	redisClient    *redis.Client
 	WorldChannel   string
 	ForwardChannel string
+	StatsKey       string
+	AuditChannel   string
 )
 
 func init() {
 	WorldChannel = config.Global.Redis.WorldChannel
 	ForwardChannel = config.Global.Redis.ForwardChannel
+	StatsKey = config.Global.Redis.StatsKey
+	AuditChannel = config.Global.Redis.AuditChannel
 
 	redisClient = redis.NewClient(&redis.Options{
 		Addr:     config.Global.Redis.Addr,
 		Password: config.Global.Redis.Password,
 		DB:       config.Global.Redis.DB,
 	})
+}
 
-	if config.Global.Distribute.Status {
-		if statusCmd := redisClient.Ping(context.Background()); statusCmd.Err() != nil {
-			log.Logger.Error("failed to ping redis server", zap.String("error", statusCmd.Err().Error()))
-			os.Exit(1)
-		}
-	}
+// check whether the redis server is reachable
+func Ping(ctx context.Context) error {
+	return redisClient.Ping(ctx).Err()
 }
 
 func GetRedisClient() *redis.Client {
@@ -49,3 +48,34 @@ func PublishForwardMsg(ctx context.Context, data []byte) (err error) {
 	_, err = redisClient.Publish(ctx, ForwardChannel, base64.StdEncoding.EncodeToString(data)).Result()
 	return
 }
+
+func PublishAuditEvent(ctx context.Context, data []byte) (err error) {
+	_, err = redisClient.Publish(ctx, AuditChannel, data).Result()
+	return
+}
+
+// get the channel which only the node with nodeID subscribes
+func NodeChannel(nodeID uint16) string {
+	return ForwardChannel + ":" + strconv.Itoa(int(nodeID))
+}
+
+func PublishNodeMsg(ctx context.Context, nodeID uint16, data []byte) (err error) {
+	_, err = redisClient.Publish(ctx, NodeChannel(nodeID), base64.StdEncoding.EncodeToString(data)).Result()
+	return
+}
+
+// save the latest statistics of a node into the stats hash
+func ReportNodeStats(ctx context.Context, nodeID string, data []byte) (err error) {
+	_, err = redisClient.HSet(ctx, StatsKey, nodeID, data).Result()
+	return
+}
+
+// get the latest statistics of all nodes, keyed by node ID
+func GetNodeStats(ctx context.Context) (map[string]string, error) {
+	return redisClient.HGetAll(ctx, StatsKey).Result()
+}
+
+func RemoveNodeStats(ctx context.Context, nodeID string) (err error) {
+	_, err = redisClient.HDel(ctx, StatsKey, nodeID).Result()
+	return
+}
@@ -1,19 +1,42 @@
 package homey
 
 import (
+	"log"
+
 	"github.com/gorilla/websocket"
 	"github.com/towerman1990/homey/config"
+	"github.com/towerman1990/homey/logger"
 	"github.com/towerman1990/homey/network"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// New creates a server which logs to stderr, the initial level depends on framework env
 func New() (homey *network.Homey) {
+	// the core enables all levels, so they could be lowered at runtime
+	l, err := logger.New(zapcore.DebugLevel, config.Global.Log)
+	if err != nil {
+		log.Printf("create logger failed, error: %v", err)
+		l = logger.Nop()
+	}
+
+	homey = NewWithLogger(l)
+	homey.SetLogLevel("", logger.EnvLevel(config.Global.Framework.Env))
+
+	return
+}
+
+// NewWithLogger creates a server which writes all logs to l
+func NewWithLogger(l *zap.Logger) (homey *network.Homey) {
+	// mixed format sends binary frames unless another frame type is chosen
 	messageType := websocket.BinaryMessage
-	if config.Global.Message.Format == "text" {
+	if config.Global.Message.Format == network.FormatText {
 		messageType = websocket.TextMessage
 	}
 
-	homey = network.NewHomey(messageType)
+	homey = network.NewHomey(messageType, l)
 	homey.MsgHandler.StartWorkPool()
+	go homey.StartStatsReporter()
 
 	return
 }
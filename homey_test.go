@@ -1,10 +1,15 @@
 package homey
 
 import (
+	"os"
 	"testing"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestNewHomey(t *testing.T) {
@@ -23,3 +28,38 @@ func TestNewHomey(t *testing.T) {
 	// Start server
 	e.Logger.Fatal(e.Start(":8080"))
 }
+
+func TestNewWithLogger(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("get working directory error: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("change working directory error: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewWithLogger(zap.New(core))
+	defer h.Stop()
+
+	h.Logger().Info("hello")
+	if logs.FilterMessage("hello").Len() != 1 {
+		t.Error("expected entry written to injected logger")
+	}
+
+	// without log file configured, New logs to stderr only
+	file := config.Global.Log.File
+	config.Global.Log.File = ""
+	defer func() { config.Global.Log.File = file }()
+	New().Stop()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read directory error: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no file created, but %s got", entries[0].Name())
+	}
+}
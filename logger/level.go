@@ -0,0 +1,51 @@
+package logger
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// levelCore filters entries by an atomic level, so the level of a logger
+// could be changed at runtime no matter how its core was built
+type levelCore struct {
+	zapcore.Core
+
+	level zap.AtomicLevel
+}
+
+func (lc *levelCore) Enabled(level zapcore.Level) bool {
+	return lc.level.Enabled(level) && lc.Core.Enabled(level)
+}
+
+func (lc *levelCore) Level() zapcore.Level {
+	return lc.level.Level()
+}
+
+func (lc *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: lc.Core.With(fields), level: lc.level}
+}
+
+func (lc *levelCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !lc.level.Enabled(entry.Level) {
+		return checked
+	}
+
+	return lc.Core.Check(entry, checked)
+}
+
+// WithLevel returns a child of l which only logs entries enabled by level,
+// it can't log entries below the level enabled by l itself
+func WithLevel(l *zap.Logger, level zap.AtomicLevel) *zap.Logger {
+	return l.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &levelCore{Core: core, level: level}
+	}))
+}
+
+// EnvLevel returns debug level on dev or develop env, otherwise info level
+func EnvLevel(env string) zapcore.Level {
+	if env == "dev" || env == "develop" {
+		return zapcore.DebugLevel
+	}
+
+	return zapcore.InfoLevel
+}
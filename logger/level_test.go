@@ -0,0 +1,27 @@
+package logger
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWithLevel(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	l := WithLevel(zap.New(core), level).With(zap.String("subsystem", "network"))
+
+	l.Debug("dropped")
+	l.Info("kept")
+	if logs.Len() != 1 {
+		t.Fatalf("expected 1 entry at info level, but %d got", logs.Len())
+	}
+
+	level.SetLevel(zapcore.DebugLevel)
+	l.Debug("kept")
+	if logs.Len() != 2 {
+		t.Fatalf("expected 2 entries after lowering level, but %d got", logs.Len())
+	}
+}
@@ -1,7 +1,6 @@
 package logger
 
 import (
-	"log"
 	"os"
 
 	"github.com/towerman1990/homey/config"
@@ -9,38 +8,37 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-var Logger *zap.Logger
-
-func init() {
-	encoder := getEncoder()
-	sync := getWriteSync()
-
-	var level zapcore.Level
-	if config.Global.Framework.Env == "dev" || config.Global.Framework.Env == "develop" {
-		level = zapcore.DebugLevel
-	} else {
-		level = zapcore.InfoLevel
+// New builds a JSON logger writing entries enabled by level to stderr,
+// and also to a rotating file if logConfig.File isn't empty
+func New(level zapcore.LevelEnabler, logConfig config.Log) (*zap.Logger, error) {
+	sync, err := getWriteSync(logConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	core := zapcore.NewCore(encoder, sync, level)
-	Logger = zap.New(core)
+	core := zapcore.NewCore(getEncoder(), sync, level)
+	return zap.New(core), nil
+}
 
-	Logger.Info("init logger success")
+// Nop returns a logger which discards everything
+func Nop() *zap.Logger {
+	return zap.NewNop()
 }
 
 func getEncoder() zapcore.Encoder {
 	return zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
 }
 
-func getWriteSync() zapcore.WriteSyncer {
-	filename := "./log/logs.txt"
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, os.ModePerm)
-	if err != nil {
-		log.Printf("open log file [%s] failed, error: %v", filename, err)
+func getWriteSync(logConfig config.Log) (zapcore.WriteSyncer, error) {
+	syncConsole := zapcore.AddSync(os.Stderr)
+	if logConfig.File == "" {
+		return syncConsole, nil
 	}
 
-	syncFile := zapcore.AddSync(file)
-	syncConsole := zapcore.AddSync(os.Stderr)
+	syncFile, err := NewRotatingFile(logConfig)
+	if err != nil {
+		return nil, err
+	}
 
-	return zapcore.NewMultiWriteSyncer(syncConsole, syncFile)
+	return zapcore.NewMultiWriteSyncer(syncConsole, syncFile), nil
 }
@@ -0,0 +1,310 @@
+package logger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+
+	// how long to wait before rotating again after a failure
+	rotateRetryInterval = time.Minute
+)
+
+var (
+	_ zapcore.WriteSyncer = (*RotatingFile)(nil)
+
+	// replaced in tests to make rotation fail
+	renameFile = os.Rename
+)
+
+type (
+	// RotatingFile is a zapcore.WriteSyncer which rotates the file by size and time,
+	// rotated files are named as <name>-<time><ext> in the same directory
+	RotatingFile struct {
+		filename string
+
+		// in bytes
+		maxSize int64
+
+		interval time.Duration
+
+		maxBackups int
+
+		maxAge time.Duration
+
+		compress bool
+
+		file *os.File
+
+		size int64
+
+		// the time when the file was opened, used for time based rotation
+		openedAt time.Time
+
+		// set once a rotation failed, so the failure is reported only once until rotation recovers
+		rotateFailed bool
+
+		// no rotation is tried before it after a failure
+		retryAt time.Time
+
+		lock sync.Mutex
+
+		millLock sync.Mutex
+	}
+
+	backupFile struct {
+		path string
+
+		rotatedAt time.Time
+	}
+)
+
+// NewRotatingFile opens or creates the log file described by logConfig
+func NewRotatingFile(logConfig config.Log) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		filename:   logConfig.File,
+		maxSize:    int64(logConfig.MaxSize) * 1024 * 1024,
+		interval:   logConfig.RotateInterval,
+		maxBackups: logConfig.MaxBackups,
+		maxAge:     time.Duration(logConfig.MaxAge) * 24 * time.Hour,
+		compress:   logConfig.Compress,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(rf.filename), 0755); err != nil {
+		return nil, fmt.Errorf("create log directory failed, error: %v", err)
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (n int, err error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	if rf.shouldRotate(int64(len(p))) {
+		if err = rf.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, err = rf.file.Write(p)
+	rf.size += int64(n)
+
+	return
+}
+
+func (rf *RotatingFile) Sync() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	return rf.file.Sync()
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+
+	return rf.file.Close()
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file [%s] failed, error: %v", rf.filename, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat log file [%s] failed, error: %v", rf.filename, err)
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.openedAt = time.Now()
+	if rf.size > 0 {
+		rf.openedAt = info.ModTime()
+	}
+
+	return nil
+}
+
+func (rf *RotatingFile) shouldRotate(writeLen int64) bool {
+	if rf.size == 0 || time.Now().Before(rf.retryAt) {
+		return false
+	}
+
+	if rf.maxSize > 0 && rf.size+writeLen > rf.maxSize {
+		return true
+	}
+
+	if rf.interval > 0 && !time.Now().Before(rf.openedAt.Truncate(rf.interval).Add(rf.interval)) {
+		return true
+	}
+
+	return false
+}
+
+// rotate moves the current file to a backup and opens a new one, logs keep going
+// to the current file if it fails
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return rf.recover(rf.filename, err)
+	}
+
+	ext := filepath.Ext(rf.filename)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(rf.filename, ext), time.Now().Format(backupTimeFormat), ext)
+	if err := renameFile(rf.filename, backup); err != nil {
+		return rf.recover(rf.filename, fmt.Errorf("rename log file [%s] failed, error: %v", rf.filename, err))
+	}
+
+	if err := rf.open(); err != nil {
+		return rf.recover(backup, err)
+	}
+	rf.rotateFailed = false
+
+	go rf.mill()
+
+	return nil
+}
+
+// recover reopens path after a failed rotation, the next rotation is postponed
+// so it isn't retried on every write
+func (rf *RotatingFile) recover(path string, cause error) error {
+	if !rf.rotateFailed {
+		rf.rotateFailed = true
+		fmt.Fprintf(os.Stderr, "rotate log file [%s] failed, error: %v\n", rf.filename, cause)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("reopen log file [%s] failed, error: %v", path, err)
+	}
+
+	// the reopened file is the one written before, so size and openedAt still hold
+	rf.file = file
+	rf.retryAt = time.Now().Add(rotateRetryInterval)
+
+	return nil
+}
+
+// mill compresses rotated files and removes the ones beyond retention
+func (rf *RotatingFile) mill() {
+	rf.millLock.Lock()
+	defer rf.millLock.Unlock()
+
+	backups, err := rf.backups()
+	if err != nil {
+		return
+	}
+
+	var expired []backupFile
+	if rf.maxBackups > 0 && len(backups) > rf.maxBackups {
+		expired = append(expired, backups[rf.maxBackups:]...)
+		backups = backups[:rf.maxBackups]
+	}
+
+	if rf.maxAge > 0 {
+		deadline := time.Now().Add(-rf.maxAge)
+		var kept []backupFile
+		for _, backup := range backups {
+			if backup.rotatedAt.Before(deadline) {
+				expired = append(expired, backup)
+			} else {
+				kept = append(kept, backup)
+			}
+		}
+		backups = kept
+	}
+
+	for _, backup := range expired {
+		os.Remove(backup.path)
+	}
+
+	if !rf.compress {
+		return
+	}
+
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup.path, ".gz") {
+			compressFile(backup.path)
+		}
+	}
+}
+
+// get rotated files, the newest one comes first
+func (rf *RotatingFile) backups() (backups []backupFile, err error) {
+	dir := filepath.Dir(rf.filename)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	ext := filepath.Ext(rf.filename)
+	prefix := strings.TrimSuffix(filepath.Base(rf.filename), ext) + "-"
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		timestamp := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext)
+		rotatedAt, err := time.ParseInLocation(backupTimeFormat, strings.TrimPrefix(timestamp, prefix), time.Local)
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backupFile{path: filepath.Join(dir, name), rotatedAt: rotatedAt})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].rotatedAt.After(backups[j].rotatedAt)
+	})
+
+	return
+}
+
+func compressFile(path string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err == nil {
+		err = gz.Close()
+	}
+
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/towerman1990/homey/config"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	rf, err := NewRotatingFile(config.Log{
+		File:       filepath.Join(dir, "logs.txt"),
+		MaxBackups: 2,
+		Compress:   true,
+	})
+	if err != nil {
+		t.Fatalf("create rotating file error: %v", err)
+	}
+	defer rf.Close()
+	rf.maxSize = 16
+
+	for i := 0; i < 4; i++ {
+		if _, err := rf.Write([]byte("0123456789\n")); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		// make sure every rotated file gets a distinct name
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	// wait for the background compression and cleanup
+	time.Sleep(100 * time.Millisecond)
+	rf.millLock.Lock()
+	defer rf.millLock.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir error: %v", err)
+	}
+
+	var backups int
+	for _, entry := range entries {
+		if entry.Name() == "logs.txt" {
+			continue
+		}
+
+		backups++
+		if !strings.HasSuffix(entry.Name(), ".txt.gz") {
+			t.Errorf("expected compressed backup, but %s got", entry.Name())
+		}
+	}
+
+	if backups != 2 {
+		t.Errorf("expected 2 backups, but %d got", backups)
+	}
+}
+
+func TestRotatingFileRenameFailed(t *testing.T) {
+	var renames int
+	renameFile = func(oldpath, newpath string) error {
+		renames++
+		return os.ErrPermission
+	}
+	defer func() { renameFile = os.Rename }()
+
+	filename := filepath.Join(t.TempDir(), "logs.txt")
+	rf, err := NewRotatingFile(config.Log{File: filename})
+	if err != nil {
+		t.Fatalf("create rotating file error: %v", err)
+	}
+	defer rf.Close()
+	rf.maxSize = 16
+
+	for i := 0; i < 3; i++ {
+		if _, err := rf.Write([]byte("0123456789\n")); err != nil {
+			t.Fatalf("expected logs kept after failed rotation, but %v got", err)
+		}
+	}
+
+	// the failed rotation is postponed instead of being retried on the next write
+	if renames != 1 {
+		t.Errorf("expected 1 rotation attempt, but %d got", renames)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("read log file error: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("expected 3 lines in log file, but %d got", lines)
+	}
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/towerman1990/homey/distribute"
+	"go.uber.org/zap"
+)
+
+type (
+	AuditEventType string
+
+	// AuditEvent is a record of connection lifecycle, it's written to the audit sink
+	// and is independent of the debug logs
+	AuditEvent struct {
+		Type AuditEventType `json:"type"`
+
+		Time time.Time `json:"time"`
+
+		NodeID uint16 `json:"node_id"`
+
+		ConnID uint64 `json:"conn_id"`
+
+		UserID string `json:"user_id,omitempty"`
+
+		RemoteAddr string `json:"remote_addr,omitempty"`
+
+		// websocket close code, only for disconnect and reject events
+		CloseCode int `json:"close_code,omitempty"`
+
+		// kick or close reason
+		Reason string `json:"reason,omitempty"`
+
+		// how long the connection has been open, only for disconnect event
+		Duration time.Duration `json:"duration,omitempty"`
+
+		BytesIn uint64 `json:"bytes_in,omitempty"`
+
+		BytesOut uint64 `json:"bytes_out,omitempty"`
+	}
+
+	// AuditSink is an append-only destination of audit events
+	AuditSink interface {
+		Write(event AuditEvent) error
+
+		Close() error
+	}
+
+	jsonLinesAuditSink struct {
+		file *os.File
+
+		encoder *json.Encoder
+
+		lock sync.Mutex
+	}
+
+	// MemoryAuditSink keeps audit events in memory, it's useful for tests
+	MemoryAuditSink struct {
+		events []AuditEvent
+
+		lock sync.RWMutex
+	}
+
+	brokerAuditSink struct{}
+)
+
+const (
+	AuditConnect      AuditEventType = "connect"
+	AuditResume       AuditEventType = "resume"
+	AuditAuthenticate AuditEventType = "authenticate"
+	AuditKick         AuditEventType = "kick"
+	AuditDisconnect   AuditEventType = "disconnect"
+
+	// the connection was rejected by OnConnOpen, so it's neither connected nor disconnected
+	AuditReject AuditEventType = "reject"
+)
+
+func (js *jsonLinesAuditSink) Write(event AuditEvent) error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+
+	return js.encoder.Encode(event)
+}
+
+func (js *jsonLinesAuditSink) Close() error {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+
+	return js.file.Close()
+}
+
+// NewJSONLinesAuditSink appends every audit event to filename as a line of JSON
+func NewJSONLinesAuditSink(filename string) (AuditSink, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open audit file [%s] failed, error: %v", filename, err)
+	}
+
+	return &jsonLinesAuditSink{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+func (ms *MemoryAuditSink) Write(event AuditEvent) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.events = append(ms.events, event)
+	return nil
+}
+
+func (ms *MemoryAuditSink) Close() error {
+	return nil
+}
+
+// get a copy of all written events
+func (ms *MemoryAuditSink) Events() []AuditEvent {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	events := make([]AuditEvent, len(ms.events))
+	copy(events, ms.events)
+
+	return events
+}
+
+func NewMemoryAuditSink() *MemoryAuditSink {
+	return &MemoryAuditSink{}
+}
+
+func (bs *brokerAuditSink) Write(event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return distribute.PublishAuditEvent(context.Background(), data)
+}
+
+func (bs *brokerAuditSink) Close() error {
+	return nil
+}
+
+// NewBrokerAuditSink publishes every audit event to the audit channel of redis
+func NewBrokerAuditSink() AuditSink {
+	return &brokerAuditSink{}
+}
+
+// SetAuditSink sets where the audit events go, it should be called before serving
+func (h *Homey) SetAuditSink(sink AuditSink) {
+	h.auditSink = sink
+}
+
+func (h *Homey) Audit(event AuditEvent) {
+	if h.auditSink == nil {
+		return
+	}
+
+	if err := h.auditSink.Write(event); err != nil {
+		h.logger.Error("failed to write audit event", zap.String("type", string(event.Type)), zap.Uint64("connection", event.ConnID), zap.String("error", err.Error()))
+	}
+}
+
+// Kick closes a connection of current node and records the reason
+func (h *Homey) Kick(connID uint64, reason string) (err error) {
+	conn, err := h.ConnManager.Get(connID)
+	if err != nil {
+		return
+	}
+
+	conn.Kick(reason)
+	return
+}
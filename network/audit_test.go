@@ -0,0 +1,148 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAuditEvents(t *testing.T) {
+	h, url, opened := newTestServer(t)
+	sink := NewMemoryAuditSink()
+	h.SetAuditSink(sink)
+	conn, client := dialTestServer(t, websocket.DefaultDialer, url, opened)
+
+	conn.SetUserID("alice")
+	if err := client.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("write message error: %v", err)
+	}
+	if err := conn.SendMsg([]byte("world")); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+	if _, _, err := client.ReadMessage(); err != nil {
+		t.Fatalf("read message error: %v", err)
+	}
+
+	// client answers the close frame while reading
+	go client.ReadMessage()
+	if err := h.Kick(conn.GetID(), "spam"); err != nil {
+		t.Fatalf("kick error: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for conn.State() != StateClosed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events := sink.Events()
+	expected := []AuditEventType{AuditConnect, AuditAuthenticate, AuditKick, AuditDisconnect}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, but %+v got", len(expected), events)
+	}
+
+	for i, event := range events {
+		if event.Type != expected[i] || event.ConnID != conn.GetID() {
+			t.Errorf("expected %s event of connection [%d], but %+v got", expected[i], conn.GetID(), event)
+		}
+	}
+
+	if events[1].UserID != "alice" || events[2].Reason != "spam" {
+		t.Errorf("unexpected authenticate or kick event: %+v, %+v", events[1], events[2])
+	}
+
+	disconnect := events[3]
+	if disconnect.CloseCode != websocket.ClosePolicyViolation || disconnect.Reason != "spam" {
+		t.Errorf("expected close code %d with reason spam, but %d %q got", websocket.ClosePolicyViolation, disconnect.CloseCode, disconnect.Reason)
+	}
+	if disconnect.Duration <= 0 || disconnect.BytesIn != 5 || disconnect.BytesOut != 5 {
+		t.Errorf("unexpected duration or bytes of disconnect event: %+v", disconnect)
+	}
+}
+
+func TestAuditRejectedConnection(t *testing.T) {
+	h, url, _ := newTestServer(t)
+	sink := NewMemoryAuditSink()
+	h.SetAuditSink(sink)
+	h.SetOnConnOpen(func(conn Connection) error {
+		return errors.New("unauthorized")
+	})
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer client.Close()
+
+	if _, _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected close code %d, but %v got", websocket.ClosePolicyViolation, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(sink.Events()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the connection never connected, so it isn't disconnected either
+	events := sink.Events()
+	if len(events) != 1 || events[0].Type != AuditReject || events[0].Reason != "unauthorized" {
+		t.Errorf("expected a single reject event, but %+v got", events)
+	}
+}
+
+func TestJSONLinesAuditSink(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewJSONLinesAuditSink(filename)
+	if err != nil {
+		t.Fatalf("create audit sink error: %v", err)
+	}
+
+	written := []AuditEvent{
+		{Type: AuditConnect, Time: time.Now().UTC(), ConnID: 1, RemoteAddr: "127.0.0.1"},
+		{Type: AuditDisconnect, Time: time.Now().UTC(), ConnID: 1, CloseCode: 1000, Duration: time.Second, BytesIn: 10, BytesOut: 20},
+	}
+	for _, event := range written {
+		if err := sink.Write(event); err != nil {
+			t.Fatalf("write audit event error: %v", err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("close audit sink error: %v", err)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("open audit file error: %v", err)
+	}
+	defer file.Close()
+
+	var read []AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unmarshal audit event error: %v", err)
+		}
+		read = append(read, event)
+	}
+
+	if len(read) != len(written) {
+		t.Fatalf("expected %d events, but %d got", len(written), len(read))
+	}
+
+	for i := range written {
+		if !read[i].Time.Equal(written[i].Time) {
+			t.Errorf("expected time %v, but %v got", written[i].Time, read[i].Time)
+		}
+		read[i].Time = written[i].Time
+
+		if read[i] != written[i] {
+			t.Errorf("expected %+v, but %+v got", written[i], read[i])
+		}
+	}
+}
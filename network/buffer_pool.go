@@ -0,0 +1,40 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// buffers beyond this size aren't put back, so a burst of large frames doesn't pin memory
+const maxPooledBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// readPooled reads r into a pooled buffer, the buffer must be put back once it isn't used
+func readPooled(r io.Reader) (*bytes.Buffer, error) {
+	buf := getBuffer()
+	if _, err := buf.ReadFrom(r); err != nil {
+		putBuffer(buf)
+		return nil, err
+	}
+
+	return buf, nil
+}
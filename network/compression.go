@@ -0,0 +1,112 @@
+package network
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+)
+
+type (
+	CompressionStats struct {
+		// outbound messages sent with compression
+		CompressedFrames uint64 `json:"compressed_frames"`
+
+		// payload bytes of outbound messages
+		PayloadBytes uint64 `json:"payload_bytes"`
+
+		// bytes of outbound messages on the wire
+		WireBytes uint64 `json:"wire_bytes"`
+	}
+
+	// countingConn counts bytes written to the network
+	countingConn struct {
+		net.Conn
+
+		written atomic.Uint64
+	}
+
+	// countingResponseWriter wraps the hijacked connection with countingConn
+	countingResponseWriter struct {
+		http.ResponseWriter
+	}
+)
+
+// get wire bytes divided by payload bytes, less is better
+func (cs CompressionStats) Ratio() float64 {
+	if cs.PayloadBytes == 0 {
+		return 0
+	}
+
+	return float64(cs.WireBytes) / float64(cs.PayloadBytes)
+}
+
+func (cc *countingConn) Write(b []byte) (n int, err error) {
+	n, err = cc.Conn.Write(b)
+	cc.written.Add(uint64(n))
+	return
+}
+
+func (cw *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := cw.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+
+	return &countingConn{Conn: conn}, rw, nil
+}
+
+func (c *connection) initCompression() {
+	if !config.Global.Compression.Status {
+		return
+	}
+
+	// the upgrader has accepted permessage-deflate if client offered it
+	for _, extension := range c.header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(extension, "permessage-deflate") {
+			c.compress.Store(true)
+			break
+		}
+	}
+
+	if err := c.Conn.SetCompressionLevel(config.Global.Compression.Level); err != nil {
+		c.Logger().Warn("failed to set compression level", zap.String("error", err.Error()))
+	}
+}
+
+func (c *connection) wireBytesWritten() uint64 {
+	if cc, ok := c.Conn.UnderlyingConn().(*countingConn); ok {
+		return cc.written.Load()
+	}
+
+	return 0
+}
+
+func (c *connection) countCompression(compressed bool, payloadBytes, wireBytes uint64) {
+	if compressed {
+		c.compressedFrames.Add(1)
+	}
+	c.wireBytesOut.Add(wireBytes)
+	c.server.MessageCounter().AddOutBytes(payloadBytes, wireBytes)
+}
+
+func (c *connection) SetCompression(enabled bool) {
+	if !enabled {
+		c.compress.Store(false)
+		return
+	}
+
+	c.initCompression()
+}
+
+func (c *connection) CompressionStats() CompressionStats {
+	return CompressionStats{
+		CompressedFrames: c.compressedFrames.Load(),
+		PayloadBytes:     c.bytesOut.Load(),
+		WireBytes:        c.wireBytesOut.Load(),
+	}
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type (
+	// ConnStats is a snapshot of a connection's traffic
+	ConnStats struct {
+		ConnID uint64 `json:"conn_id"`
+
+		UserID string `json:"user_id,omitempty"`
+
+		RemoteAddr string `json:"remote_addr,omitempty"`
+
+		State string `json:"state"`
+
+		OpenedAt time.Time `json:"opened_at"`
+
+		// last time an application message arrived
+		LastActivity time.Time `json:"last_activity"`
+
+		// the latest round trip time measured by ping and pong
+		RTT time.Duration `json:"rtt"`
+
+		FramesIn uint64 `json:"frames_in"`
+
+		FramesOut uint64 `json:"frames_out"`
+
+		BytesIn uint64 `json:"bytes_in"`
+
+		BytesOut uint64 `json:"bytes_out"`
+
+		// outbound messages dropped by full send queue
+		Dropped uint64 `json:"dropped"`
+
+		// inbound messages dropped by rate limit
+		RateLimited uint64 `json:"rate_limited"`
+
+		HandlerErrors uint64 `json:"handler_errors"`
+	}
+
+	// ServerConnStats is statistics of all connections of a server
+	ServerConnStats struct {
+		Connections []ConnStats `json:"connections"`
+
+		Total ConnStatsTotal `json:"total"`
+	}
+
+	ConnStatsTotal struct {
+		Connections int `json:"connections"`
+
+		FramesIn uint64 `json:"frames_in"`
+
+		FramesOut uint64 `json:"frames_out"`
+
+		BytesIn uint64 `json:"bytes_in"`
+
+		BytesOut uint64 `json:"bytes_out"`
+
+		Dropped uint64 `json:"dropped"`
+
+		RateLimited uint64 `json:"rate_limited"`
+
+		HandlerErrors uint64 `json:"handler_errors"`
+	}
+
+	handlerErrorCounter interface {
+		incHandlerErrors()
+	}
+)
+
+func (c *connection) Stats() ConnStats {
+	return ConnStats{
+		ConnID:        c.ID,
+		UserID:        c.GetUserID(),
+		RemoteAddr:    c.RemoteAddr(),
+		State:         c.State().String(),
+		OpenedAt:      c.openedAt,
+		LastActivity:  time.Unix(0, c.lastActivity.Load()),
+		RTT:           c.RTT(),
+		FramesIn:      c.framesIn.Load(),
+		FramesOut:     c.framesOut.Load(),
+		BytesIn:       c.bytesIn.Load(),
+		BytesOut:      c.bytesOut.Load(),
+		Dropped:       c.dropped.Load(),
+		RateLimited:   c.RateLimitStats().Dropped,
+		HandlerErrors: c.handlerErrors.Load(),
+	}
+}
+
+func (c *connection) incHandlerErrors() {
+	c.handlerErrors.Add(1)
+}
+
+func countHandlerError(request Request) {
+	if counter, ok := request.GetConnection().(handlerErrorCounter); ok {
+		counter.incHandlerErrors()
+	}
+}
+
+// ConnectionStats returns statistics of connections of current node which filter returns true for,
+// all connections are included if filter is nil
+func (h *Homey) ConnectionStats(filter func(ConnStats) bool) (stats ServerConnStats) {
+	stats.Connections = []ConnStats{}
+	for _, conn := range h.ConnManager.All() {
+		connStats := conn.Stats()
+		if filter != nil && !filter(connStats) {
+			continue
+		}
+
+		stats.Connections = append(stats.Connections, connStats)
+		stats.Total.add(connStats)
+	}
+
+	sort.Slice(stats.Connections, func(i, j int) bool {
+		return stats.Connections[i].ConnID < stats.Connections[j].ConnID
+	})
+
+	return
+}
+
+func (total *ConnStatsTotal) add(stats ConnStats) {
+	total.Connections++
+	total.FramesIn += stats.FramesIn
+	total.FramesOut += stats.FramesOut
+	total.BytesIn += stats.BytesIn
+	total.BytesOut += stats.BytesOut
+	total.Dropped += stats.Dropped
+	total.RateLimited += stats.RateLimited
+	total.HandlerErrors += stats.HandlerErrors
+}
+
+// ConnStatsHandler returns a handler to get statistics of connections of current node,
+// append ?user=<user ID> or ?connection=<connection ID> to get the ones of a single user or connection
+func (h *Homey) ConnStatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := r.URL.Query().Get("user")
+		var connID uint64
+		if value := r.URL.Query().Get("connection"); value != "" {
+			var err error
+			if connID, err = strconv.ParseUint(value, 10, 64); err != nil {
+				http.Error(w, "must specify a valid connection ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		stats := h.ConnectionStats(func(stats ConnStats) bool {
+			return (userID == "" || stats.UserID == userID) && (connID == 0 || stats.ConnID == connID)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+}
@@ -1,15 +1,22 @@
 package network
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/towerman1990/homey/config"
 	"github.com/towerman1990/homey/distribute"
-	log "github.com/towerman1990/homey/logger"
+	"github.com/towerman1990/homey/utils"
 	"go.uber.org/zap"
 )
 
@@ -22,6 +29,16 @@ var (
 	PingPeriod = (PongWait * 9) / 10
 	// Maximum message size allowed from peer.
 	MaxMessageSize int64 = 64 * 1024
+	// Time allowed to flush pending messages and wait for peer's close frame.
+	CloseGracePeriod = 3 * time.Second
+
+	errFrameTooLarge = errors.New("frame beyond max message size")
+)
+
+// close codes in the range reserved for applications
+const (
+	CloseIdleTimeout      = 4001
+	CloseLifetimeExceeded = 4002
 )
 
 type (
@@ -33,9 +50,20 @@ type (
 		// establish a connection between server and client
 		Open()
 
-		// close a connection
+		// close a connection normally, it's the same as CloseWithReason(1000, "")
 		Close()
 
+		// flush pending messages, send a close frame and close the underlying connection
+		// once peer's close frame arrived or a bounded time passed, it returns without
+		// waiting, Context is done once the connection is closed
+		CloseWithReason(code int, reason string)
+
+		// get close code sent by server or client, 0 if it's still open
+		CloseCode() int
+
+		// get close reason sent by server or client
+		CloseReason() string
+
 		// reading message from websocket connection
 		StartReader()
 
@@ -45,7 +73,104 @@ type (
 		// server send message to client by connection
 		SendMsg(data []byte) error
 
+		// send message through the lane of priority, SendMsg uses normal priority
+		SendMsgWithPriority(data []byte, priority Priority) error
+
+		// send message as a websocket frame of frameType, 0 means the server's message type
+		SendMsgWithFrameType(data []byte, frameType int) error
+
+		// send message as a text frame
+		SendText(data []byte) error
+
+		// send message as a binary frame
+		SendBinary(data []byte) error
+
+		// send message and wait until it's written into websocket connection,
+		// or ctx is done, the message is discarded if ctx is done before writing
+		SendMsgContext(ctx context.Context, data []byte) error
+
+		// send message without waiting, callback is called by the writer once the
+		// message is written or discarded, so it must not block
+		SendMsgAsync(data []byte, callback func(error))
+
+		// send message without waiting for space of send queue, with block policy the
+		// message is dropped if the queue is full
+		TrySendMsg(data []byte) error
+
+		// close the connection and record the reason into audit sink
+		Kick(reason string)
+
+		// get lifecycle state of the connection
+		State() ConnState
+
+		// add an observer which is called after the state changed
+		OnStateChange(observer StateObserver)
+
 		Context() context.Context
+
+		// get client IP, X-Forwarded-For is honoured if the request came from a trusted proxy
+		RemoteAddr() string
+
+		// get headers of the upgraded http request
+		Header() http.Header
+
+		// get query parameters of the upgraded http request
+		Query() url.Values
+
+		// get a cookie of the upgraded http request
+		Cookie(name string) (*http.Cookie, error)
+
+		// get negotiated subprotocol
+		Subprotocol() string
+
+		// get TLS state of the upgraded http request, nil if it isn't over TLS
+		TLS() *tls.ConnectionState
+
+		// opt this connection in or out of compression, it only takes effect if
+		// permessage-deflate was negotiated
+		SetCompression(enabled bool)
+
+		// get compression statistics of outbound messages
+		CompressionStats() CompressionStats
+
+		// tell whether the connection resumed a previous session
+		IsResumed() bool
+
+		// send message with a sequence number, it's delivered at least once
+		SendReliable(msg Message) error
+
+		// get count of reliable messages waiting for acknowledgement
+		UnackedCount() int
+
+		// get counters of inbound rate limit
+		RateLimitStats() RateLimitStats
+
+		// get traffic statistics of the connection
+		Stats() ConnStats
+
+		// set a custom property, it's safe for concurrent handlers
+		SetProperty(key string, value interface{})
+
+		GetProperty(key string) (value interface{}, ok bool)
+
+		DeleteProperty(key string)
+
+		// call f for each property until it returns false
+		RangeProperties(f func(key string, value interface{}) bool)
+
+		// add an observer which is called after a property is set or deleted
+		OnPropertyChange(observer PropertyObserver)
+
+		// get the latest round trip time measured by ping and pong
+		RTT() time.Duration
+
+		// get the logger carrying connection ID, remote address, node ID and user ID
+		Logger() *zap.Logger
+
+		// bind an authenticated user to the connection, it's carried by the connection's logs
+		SetUserID(userID string)
+
+		GetUserID() string
 	}
 
 	connection struct {
@@ -53,9 +178,90 @@ type (
 
 		server Server
 
+		logger atomic.Pointer[zap.Logger]
+
+		// sampled logger for per message logs
+		msgLogger atomic.Pointer[zap.Logger]
+
+		userID atomic.Value
+
 		Conn *websocket.Conn
 
-		sendMsgChan chan *[]byte
+		// metadata of the upgraded http request
+		remoteAddr string
+
+		header http.Header
+
+		query url.Values
+
+		subprotocol string
+
+		tlsState *tls.ConnectionState
+
+		// whether outbound messages are compressed
+		compress atomic.Bool
+
+		compressedFrames atomic.Uint64
+
+		// bytes of outbound messages on the wire, including frame headers
+		wireBytesOut atomic.Uint64
+
+		openedAt time.Time
+
+		// lifetime is measured from it, a resumed connection inherits it from its session
+		startedAt time.Time
+
+		// taken from config on creating, so the timeout watcher never reads the config
+		idleTimeout, maxLifetime time.Duration
+
+		bytesIn atomic.Uint64
+
+		bytesOut atomic.Uint64
+
+		framesIn atomic.Uint64
+
+		framesOut atomic.Uint64
+
+		// errors returned by handlers of the connection's requests
+		handlerErrors atomic.Uint64
+
+		// close code sent by client or server
+		closeCode atomic.Int32
+
+		closeReason atomic.Value
+
+		// ConnState of the connection
+		state atomic.Int32
+
+		stateObservers []StateObserver
+
+		stateLock sync.RWMutex
+
+		// ask writer to flush pending messages and send close frame
+		closeFrameChan chan []byte
+
+		// closed once reader stopped
+		readerDone chan struct{}
+
+		// round trip time in nanoseconds
+		rtt atomic.Int64
+
+		// unix nano time of the latest inbound application message
+		lastActivity atomic.Int64
+
+		// nil if rate limit is disabled
+		rateLimiter *rateLimiter
+
+		// nil if session is disabled
+		session *session
+
+		resumed bool
+
+		// nil if reliable delivery is disabled
+		reliable *reliableWindow
+
+		// send queue lanes indexed by priority
+		sendLanes [priorityCount]chan *outMsg
 
 		ctx context.Context
 
@@ -63,11 +269,12 @@ type (
 
 		properties map[string]interface{}
 
-		sync.RWMutex
+		propertyObservers []PropertyObserver
 
 		propertyLock sync.RWMutex
 
-		isClosed bool
+		// outbound messages dropped by full send queue
+		dropped atomic.Uint64
 	}
 )
 
@@ -76,70 +283,203 @@ func (c *connection) GetID() uint64 {
 }
 
 func (c *connection) Open() {
-	c.ctx, c.cancel = context.WithCancel(context.Background())
-
 	if err := c.server.CallOnConnOpen(c); err != nil {
-		log.Logger.Warn("connection [%d] open failed, error: %v", zap.Uint64("connection", c.ID), zap.String("error", err.Error()))
+		c.Logger().Warn("connection open failed", zap.String("error", err.Error()))
+		c.sendCloseFrame(websocket.ClosePolicyViolation, err.Error())
+		c.cancel()
+		c.finalizer(AuditReject)
 		return
 	}
+	c.advance(StateOpen)
+
+	if c.resumed {
+		c.server.Audit(c.newAuditEvent(AuditResume, ""))
+	} else {
+		c.server.Audit(c.newAuditEvent(AuditConnect, ""))
+	}
+	c.startSession()
 
 	go c.StartReader()
 	go c.StartWriter()
+	go c.watchTimeouts()
 
 	select {
 	case <-c.ctx.Done():
-		c.finalizer()
+		c.finalizer(AuditDisconnect)
 		return
 	}
 }
 
 func (c *connection) Close() {
+	c.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+func (c *connection) CloseWithReason(code int, reason string) {
+	if c.ctx.Err() != nil || !c.advance(StateClosing) {
+		return
+	}
+	c.setCloseStatus(code, reason)
+	gracePeriod := CloseGracePeriod
+
+	// the writer is the only one allowed to write data frames, so it sends the
+	// close frame after all pending messages, it may not be started yet
+	c.closeFrameChan <- websocket.FormatCloseMessage(code, reason)
+
+	// handlers share worker goroutines, so they mustn't wait for a slow peer
+	go c.waitPeerClose(gracePeriod)
+}
+
+// waitPeerClose closes the underlying connection once peer answered the close frame,
+// or the grace period passed
+func (c *connection) waitPeerClose(gracePeriod time.Duration) {
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-c.readerDone:
+	case <-c.ctx.Done():
+	case <-timer.C:
+		c.Logger().Warn("timeout waiting for peer's close frame")
+	}
+
 	c.cancel()
 }
 
-func (c *connection) finalizer() {
-	c.server.CallOnConnClose(c)
+func (c *connection) CloseCode() int {
+	return int(c.closeCode.Load())
+}
+
+func (c *connection) CloseReason() string {
+	reason, _ := c.closeReason.Load().(string)
+	return reason
+}
+
+func (c *connection) setCloseStatus(code int, reason string) {
+	c.closeCode.Store(int32(code))
+	c.closeReason.Store(reason)
+}
+
+// sendCloseFrame tells peer why the connection is going to be closed, it doesn't wait for
+// peer's close frame, so it's used for protocol errors which the connection is aborted on
+func (c *connection) sendCloseFrame(code int, reason string) {
+	c.advance(StateClosing)
+	c.setCloseStatus(code, reason)
+
+	data := websocket.FormatCloseMessage(code, reason)
+	if err := c.Conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(WriteWait)); err != nil {
+		c.Logger().Warn("failed to send close frame", zap.Int("code", code), zap.String("error", err.Error()))
+	}
+}
+
+func (c *connection) Kick(reason string) {
+	c.server.Audit(c.newAuditEvent(AuditKick, reason))
+	c.CloseWithReason(websocket.ClosePolicyViolation, reason)
+}
+
+func (c *connection) newAuditEvent(eventType AuditEventType, reason string) AuditEvent {
+	return AuditEvent{
+		Type:       eventType,
+		Time:       time.Now(),
+		NodeID:     utils.NodeID(),
+		ConnID:     c.ID,
+		UserID:     c.GetUserID(),
+		RemoteAddr: c.RemoteAddr(),
+		Reason:     reason,
+	}
+}
 
-	c.Lock()
-	defer c.Unlock()
+// finalizer cleans up the closed connection, eventType is the audit event written for it
+func (c *connection) finalizer(eventType AuditEventType) {
+	c.server.CallOnConnClose(c)
 
-	if c.isClosed == true {
+	if c.State() == StateClosed {
 		return
 	}
 
-	log.Logger.Info("ready to close connection", zap.Uint64("connection", c.ID), zap.String("remote addr", c.Conn.RemoteAddr().String()))
-	close(c.sendMsgChan)
+	c.Logger().Info("ready to close connection")
 	err := c.Conn.Close()
 	if err != nil {
-		log.Logger.Error("close connection [%d] failed, error: %v", zap.Uint64("connection", c.ID), zap.String("error", err.Error()))
+		c.Logger().Error("failed to close connection", zap.String("error", err.Error()))
 	}
-	c.isClosed = true
+
+	event := c.newAuditEvent(eventType, c.CloseReason())
+	event.CloseCode = c.CloseCode()
+	event.Duration = time.Since(c.openedAt)
+	event.BytesIn = c.bytesIn.Load()
+	event.BytesOut = c.bytesOut.Load()
+	c.server.Audit(event)
 
 	c.server.ConnectionManager().Remove(c)
+	c.endSession()
+	c.advance(StateClosed)
 }
 
 func (c *connection) StartReader() {
-	defer c.Close()
-	defer log.Logger.Info("close connection reader", zap.Uint64("id", c.ID))
+	defer c.cancel()
+	defer close(c.readerDone)
+	defer c.Logger().Info("close connection reader")
+
+	c.Conn.SetReadDeadline(time.Now().Add(PongWait))
+	c.Conn.SetPongHandler(c.handlePong)
 
 	for {
-		messageType, binaryMessage, err := c.Conn.ReadMessage()
+		messageType, buf, err := c.readFrame()
 		if err != nil {
-			log.Logger.Error("failed to read message", zap.Uint64("connection", c.ID), zap.String("error", err.Error()))
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				// the close frame of peer either answers ours or starts the closing handshake
+				if c.advance(StateClosing) {
+					c.setCloseStatus(closeErr.Code, closeErr.Text)
+				}
+				c.Logger().Info("connection closed by peer", zap.Int("code", closeErr.Code), zap.String("reason", closeErr.Text))
+				return
+			}
+			c.Logger().Error("failed to read message", zap.String("error", err.Error()))
+
+			if errors.Is(err, errFrameTooLarge) {
+				c.sendCloseFrame(websocket.CloseMessageTooBig, fmt.Sprintf("frame beyond %d bytes", MaxMessageSize))
+			}
 			return
 		}
-
-		log.Logger.Info("received message", zap.Int("message type", messageType))
-
-		msg, err := UnPack(binaryMessage, false)
+		size := buf.Len()
+		c.framesIn.Add(1)
+		c.bytesIn.Add(uint64(size))
+		// any frame from peer proves it's alive
+		c.Conn.SetReadDeadline(time.Now().Add(PongWait))
+
+		c.msgLogger.Load().Debug("received message", zap.Int("message type", messageType), zap.Int("length", size))
+		c.server.MessageCounter().IncIn()
+
+		msg, err := UnPack(buf.Bytes(), false)
+		if err == nil {
+			// handlers outlive the pooled buffer, so only the payload is copied out
+			msg.SetData(append([]byte(nil), msg.GetData()...))
+		}
+		putBuffer(buf)
 		if err != nil {
-			log.Logger.Error("failed to unpack message", zap.Uint64("connection", c.ID), zap.String("error", err.Error()))
+			c.Logger().Error("failed to unpack message", zap.String("error", err.Error()))
+
+			if errors.Is(err, ErrPackageTooLarge) {
+				c.sendCloseFrame(websocket.CloseMessageTooBig, "package beyond max package size")
+			} else {
+				c.sendCloseFrame(websocket.CloseInvalidFramePayloadData, "malformed package")
+			}
 			break
 		}
 
+		// heartbeats and acks are limited too, or a client could flood them for free
+		if !c.allowMsg(msg, size) {
+			continue
+		}
+
+		if c.handleHeartbeat(msg, messageType) || c.handleAck(msg) {
+			continue
+		}
+		c.lastActivity.Store(time.Now().UnixNano())
+
 		req := &request{
-			conn: c,
-			msg:  msg,
+			conn:      c,
+			msg:       msg,
+			frameType: messageType,
 		}
 
 		if config.Global.WorkerPoolSize > 0 {
@@ -150,41 +490,203 @@ func (c *connection) StartReader() {
 	}
 }
 
+// readFrame reads a whole data frame into a pooled buffer, the size limit is enforced here
+// rather than by websocket.Conn.SetReadLimit, which sends its own close frame without reason
+func (c *connection) readFrame() (messageType int, buf *bytes.Buffer, err error) {
+	messageType, r, err := c.Conn.NextReader()
+	if err != nil {
+		return
+	}
+
+	if buf, err = readPooled(io.LimitReader(r, MaxMessageSize+1)); err != nil {
+		return
+	}
+
+	if int64(buf.Len()) > MaxMessageSize {
+		putBuffer(buf)
+		return messageType, nil, errFrameTooLarge
+	}
+
+	return
+}
+
 func (c *connection) StartWriter() {
-	defer log.Logger.Info("close connection writer", zap.Uint64("id", c.ID))
+	defer c.Logger().Info("close connection writer")
+	defer c.discardQueue()
 	ticker := time.NewTicker(PingPeriod)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case data := <-c.sendMsgChan:
-			if err := c.Conn.WriteMessage(c.server.GetMsgType(), *data); err != nil {
-				log.Logger.Error("failed to write message", zap.Uint64("connection", c.ID), zap.String("error", err.Error()))
-				c.Close()
+		case msg := <-c.sendLanes[PriorityControl]:
+			if err := c.writeByPriority(msg); err != nil {
+				c.Logger().Error("failed to write message", zap.String("error", err.Error()))
+				c.cancel()
+				return
+			}
+		case msg := <-c.sendLanes[PriorityNormal]:
+			if err := c.writeByPriority(msg); err != nil {
+				c.Logger().Error("failed to write message", zap.String("error", err.Error()))
+				c.cancel()
+				return
+			}
+		case msg := <-c.sendLanes[PriorityBulk]:
+			if err := c.writeByPriority(msg); err != nil {
+				c.Logger().Error("failed to write message", zap.String("error", err.Error()))
+				c.cancel()
 				return
 			}
 		case <-ticker.C:
-			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Logger.Error("failed to ping client", zap.Uint64("connection", c.ID), zap.String("error", err.Error()))
+			c.Conn.SetWriteDeadline(time.Now().Add(WriteWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, pingPayload()); err != nil {
+				c.Logger().Error("failed to ping client", zap.String("error", err.Error()))
+				c.cancel()
 				return
 			}
+		case closeFrame := <-c.closeFrameChan:
+			c.flushQueue()
+
+			c.Conn.SetWriteDeadline(time.Now().Add(WriteWait))
+			if err := c.Conn.WriteMessage(websocket.CloseMessage, closeFrame); err != nil {
+				c.Logger().Warn("failed to send close frame", zap.String("error", err.Error()))
+				c.cancel()
+			}
+
+			// messages which raced with closing are finished until the connection is cancelled
+			c.discardUntilDone()
+			return
 		case <-c.ctx.Done():
 			return
 		}
 	}
 }
 
+func (c *connection) writeMsg(msg *outMsg) (err error) {
+	if msg.ctx != nil && msg.ctx.Err() != nil {
+		msg.finish(msg.ctx.Err())
+		return
+	}
+
+	compress := c.compress.Load() && len(msg.data) >= config.Global.Compression.Threshold
+	c.Conn.EnableWriteCompression(compress)
+
+	wireBytes := c.wireBytesWritten()
+	c.Conn.SetWriteDeadline(time.Now().Add(WriteWait))
+	frameType := msg.frameType
+	if frameType == 0 {
+		frameType = c.server.GetMsgType()
+	}
+	err = c.writeFrame(frameType, msg.data)
+	msg.finish(err)
+	if err != nil {
+		return
+	}
+	c.countCompression(compress, uint64(len(msg.data)), c.wireBytesWritten()-wireBytes)
+
+	c.server.MessageCounter().IncOut()
+	c.framesOut.Add(1)
+	c.bytesOut.Add(uint64(len(msg.data)))
+
+	return
+}
+
+func (c *connection) writeFrame(frameType int, data []byte) (err error) {
+	w, err := c.Conn.NextWriter(frameType)
+	if err != nil {
+		return
+	}
+
+	_, err = w.Write(data)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+
+	return
+}
+
 func (c *connection) SendMsg(data []byte) (err error) {
-	if c.isClosed {
+	return c.SendMsgWithPriority(data, PriorityNormal)
+}
+
+func (c *connection) SendMsgWithPriority(data []byte, priority Priority) (err error) {
+	if priority >= priorityCount {
+		return fmt.Errorf("invalid priority [%d]", priority)
+	}
+
+	return c.send(&outMsg{data: data, priority: priority})
+}
+
+func (c *connection) SendMsgWithFrameType(data []byte, frameType int) (err error) {
+	if frameType != 0 && frameType != websocket.TextMessage && frameType != websocket.BinaryMessage {
+		return fmt.Errorf("invalid frame type [%d]", frameType)
+	}
+
+	return c.send(&outMsg{data: data, priority: PriorityNormal, frameType: frameType})
+}
+
+func (c *connection) SendText(data []byte) error {
+	return c.SendMsgWithFrameType(data, websocket.TextMessage)
+}
+
+func (c *connection) SendBinary(data []byte) error {
+	return c.SendMsgWithFrameType(data, websocket.BinaryMessage)
+}
+
+func (c *connection) send(msg *outMsg) (err error) {
+	if c.closed() {
+		// the session may be resumed by a new connection, or waiting for it
+		if c.session != nil {
+			return c.session.send(msg.data)
+		}
 		return fmt.Errorf("connection [%d] has closed", c.ID)
 	}
 
-	c.sendMsgChan <- &data
-	return
+	return c.enqueue(msg)
+}
+
+func (c *connection) SendMsgContext(ctx context.Context, data []byte) (err error) {
+	if c.closed() {
+		return fmt.Errorf("connection [%d] has closed", c.ID)
+	}
+
+	result := make(chan error, 1)
+	msg := &outMsg{
+		data:     data,
+		priority: PriorityNormal,
+		ctx:      ctx,
+		done:     func(err error) { result <- err },
+	}
+	if err = c.enqueue(msg); err != nil {
+		return
+	}
+
+	select {
+	case err = <-result:
+		return
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ctx.Done():
+		return fmt.Errorf("connection [%d] has closed", c.ID)
+	}
+}
+
+func (c *connection) SendMsgAsync(data []byte, callback func(error)) {
+	if c.closed() {
+		callback(fmt.Errorf("connection [%d] has closed", c.ID))
+		return
+	}
+
+	if err := c.enqueue(&outMsg{data: data, priority: PriorityNormal, done: callback}); err != nil {
+		callback(err)
+	}
+}
+
+func (c *connection) TrySendMsg(data []byte) error {
+	return c.send(&outMsg{data: data, priority: PriorityNormal, noWait: true})
 }
 
 func (c *connection) SendForwardMsg(data []byte) (err error) {
-	if c.isClosed {
+	if c.closed() {
 		return fmt.Errorf("connection [%d] has closed", c.ID)
 	}
 
@@ -192,36 +694,69 @@ func (c *connection) SendForwardMsg(data []byte) (err error) {
 	return
 }
 
+// Deprecated: GetStatus tells whether the connection is open, use State instead
 func (c *connection) GetStatus() bool {
-	return c.isClosed
+	return c.State() == StateOpen
 }
 
 func (c *connection) Context() context.Context {
 	return c.ctx
 }
 
-func (c *connection) SetProperty(key string, value interface{}) {
-	c.propertyLock.RLock()
-	defer c.propertyLock.RUnlock()
+func (c *connection) Logger() *zap.Logger {
+	return c.logger.Load()
+}
+
+func (c *connection) SetUserID(userID string) {
+	c.userID.Store(userID)
+	c.bindLoggers(zap.String("user", userID))
+	c.server.Audit(c.newAuditEvent(AuditAuthenticate, ""))
+}
 
-	c.properties[key] = value
+func (c *connection) GetUserID() string {
+	userID, _ := c.userID.Load().(string)
+	return userID
 }
 
-func (c *connection) GetProperty(key string) (value interface{}, ok bool) {
-	c.propertyLock.RLock()
-	defer c.propertyLock.RUnlock()
+func (c *connection) bindLoggers(fields ...zap.Field) {
+	fields = append([]zap.Field{
+		zap.Uint64("connection", c.ID),
+		zap.String("remote_addr", c.RemoteAddr()),
+		zap.Uint16("node", utils.NodeID()),
+	}, fields...)
 
-	value, ok = c.properties[key]
-	return
+	c.logger.Store(c.server.Logger().With(fields...))
+	c.msgLogger.Store(c.server.MessageLogger().With(fields...))
 }
 
-func NewEchoConnection(id uint64, server Server, conn *websocket.Conn) Connection {
+// NewEchoConnection creates a connection, r is the http request which was upgraded
+func NewEchoConnection(id uint64, server Server, conn *websocket.Conn, r *http.Request) Connection {
 	echoConn := &connection{
-		ID:          id,
-		server:      server,
-		Conn:        conn,
-		sendMsgChan: make(chan *[]byte),
+		ID:             id,
+		server:         server,
+		Conn:           conn,
+		openedAt:       time.Now(),
+		idleTimeout:    config.Global.Connection.IdleTimeout,
+		maxLifetime:    config.Global.Connection.MaxLifetime,
+		closeFrameChan: make(chan []byte, 1),
+		properties:     make(map[string]interface{}),
+		readerDone:     make(chan struct{}),
+		remoteAddr:     clientIP(r),
+		header:         r.Header.Clone(),
+		query:          r.URL.Query(),
+		subprotocol:    conn.Subprotocol(),
+		tlsState:       r.TLS,
+		rateLimiter:    newRateLimiter(),
+		reliable:       newReliableWindow(),
+	}
+	for priority := range echoConn.sendLanes {
+		echoConn.sendLanes[priority] = make(chan *outMsg, sendQueueSize())
 	}
+	echoConn.startedAt = echoConn.openedAt
+	echoConn.ctx, echoConn.cancel = context.WithCancel(context.Background())
+	echoConn.lastActivity.Store(echoConn.openedAt.UnixNano())
+	echoConn.bindLoggers()
+	echoConn.initCompression()
 	echoConn.server.ConnectionManager().Add(echoConn)
 
 	return echoConn
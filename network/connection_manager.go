@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"sync"
 
-	log "github.com/towerman1990/homey/logger"
+	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 )
 
@@ -23,6 +23,9 @@ type (
 		// count how many connections in total
 		Count() int
 
+		// get a snapshot of all connections
+		All() []Connection
+
 		// disconnect all connections
 		Clear()
 	}
@@ -32,6 +35,8 @@ type (
 		connections map[uint64]Connection
 
 		lock sync.RWMutex
+
+		logger *zap.Logger
 	}
 )
 
@@ -40,20 +45,24 @@ func (cm *connectionManager) Add(conn Connection) {
 	defer cm.lock.Unlock()
 
 	cm.connections[conn.GetID()] = conn
-	log.Logger.Info("connection was added into connection manager successfully", zap.Uint64("connection", conn.GetID()))
+	cm.logger.Info("connection was added into connection manager successfully", zap.Uint64("connection", conn.GetID()))
 }
 
 func (cm *connectionManager) Remove(conn Connection) {
 	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	// a resumed connection may have taken the ID already
+	if cm.connections[conn.GetID()] == conn {
+		delete(cm.connections, conn.GetID())
+	}
+	cm.lock.Unlock()
+
 	conn.Close()
-	delete(cm.connections, conn.GetID())
 }
 
 func (cm *connectionManager) Get(connID uint64) (conn Connection, err error) {
 	cm.lock.RLock()
 	defer cm.lock.RUnlock()
-	if conn, ok := cm.connections[conn.GetID()]; ok {
+	if conn, ok := cm.connections[connID]; ok {
 		return conn, err
 	}
 
@@ -61,21 +70,45 @@ func (cm *connectionManager) Get(connID uint64) (conn Connection, err error) {
 }
 
 func (cm *connectionManager) Count() int {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+
 	return len(cm.connections)
 }
 
-func (cm *connectionManager) Clear() {
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+func (cm *connectionManager) All() []Connection {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
 
+	conns := make([]Connection, 0, len(cm.connections))
 	for _, conn := range cm.connections {
-		cm.Remove(conn)
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+func (cm *connectionManager) Clear() {
+	conns := cm.All()
+
+	// close handshakes are waited concurrently
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn Connection) {
+			defer wg.Done()
+			conn.CloseWithReason(websocket.CloseGoingAway, "server shutting down")
+			<-conn.Context().Done()
+			cm.Remove(conn)
+		}(conn)
 	}
+	wg.Wait()
 }
 
-func NewConnectionManager() ConnectionManager {
+func NewConnectionManager(logger *zap.Logger) ConnectionManager {
 	return &connectionManager{
 		connections: make(map[uint64]Connection),
 		lock:        sync.RWMutex{},
+		logger:      logger,
 	}
 }
@@ -0,0 +1,523 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/towerman1990/homey/config"
+	"github.com/towerman1990/homey/utils"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// start a homey server, its connections are sent to opened on open
+func newTestServer(t *testing.T) (h *Homey, url string, opened chan Connection) {
+	h = NewHomey(websocket.TextMessage, nil)
+	opened = make(chan Connection, 1)
+	h.SetOnConnOpen(func(conn Connection) error {
+		opened <- conn
+		return nil
+	})
+
+	e := echo.New()
+	e.GET("/ws", h.Echo())
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	return h, "ws" + strings.TrimPrefix(server.URL, "http") + "/ws", opened
+}
+
+// dial url of a test server, the server side connection is returned on open
+func dialTestServer(t *testing.T, dialer *websocket.Dialer, url string, opened chan Connection) (Connection, *websocket.Conn) {
+	client, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case conn := <-opened:
+		return conn, client
+	case <-time.After(time.Second):
+		t.Fatal("connection wasn't opened")
+	}
+
+	return nil, nil
+}
+
+// start a homey server and dial it, the server side connection is returned on open
+func newTestConnection(t *testing.T, dialer *websocket.Dialer) (*Homey, Connection, *websocket.Conn) {
+	h, url, opened := newTestServer(t)
+	conn, client := dialTestServer(t, dialer, url, opened)
+
+	return h, conn, client
+}
+
+func TestSendMsgContextAndAsync(t *testing.T) {
+	_, conn, client := newTestConnection(t, websocket.DefaultDialer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := conn.SendMsgContext(ctx, []byte("sync")); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	written := make(chan error, 1)
+	conn.SendMsgAsync([]byte("async"), func(err error) { written <- err })
+	if err := <-written; err != nil {
+		t.Fatalf("send async message error: %v", err)
+	}
+
+	for _, expected := range []string{"sync", "async"} {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read message error: %v", err)
+		}
+
+		if string(data) != expected {
+			t.Errorf("expected %s, but %s got", expected, data)
+		}
+	}
+
+	// client answers the close frame while reading
+	go client.ReadMessage()
+	conn.Close()
+	if err := conn.SendMsgContext(context.Background(), []byte("closed")); err == nil {
+		t.Error("expected error on sending to closed connection")
+	}
+}
+
+func TestPingMeasuresRTT(t *testing.T) {
+	pingPeriod := PingPeriod
+	PingPeriod = 20 * time.Millisecond
+	defer func() { PingPeriod = pingPeriod }()
+
+	_, conn, client := newTestConnection(t, websocket.DefaultDialer)
+	// client answers pings while reading
+	go func() {
+		for {
+			if _, _, err := client.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for conn.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("rtt wasn't measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOversizeFrameClosedWithCode(t *testing.T) {
+	_, _, client := newTestConnection(t, websocket.DefaultDialer)
+
+	if err := client.WriteMessage(websocket.TextMessage, make([]byte, MaxMessageSize+1)); err != nil {
+		t.Fatalf("write message error: %v", err)
+	}
+
+	_, _, err := client.ReadMessage()
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok || closeErr.Code != websocket.CloseMessageTooBig {
+		t.Fatalf("expected close code %d, but %v got", websocket.CloseMessageTooBig, err)
+	}
+
+	if expected := fmt.Sprintf("frame beyond %d bytes", MaxMessageSize); closeErr.Text != expected {
+		t.Errorf("expected close reason %q, but %q got", expected, closeErr.Text)
+	}
+}
+
+func TestCloseWithReason(t *testing.T) {
+	h, conn, client := newTestConnection(t, websocket.DefaultDialer)
+	closed := make(chan Connection, 1)
+	h.SetOnConnClose(func(conn Connection) {
+		closed <- conn
+	})
+
+	if err := conn.SendMsg([]byte("pending")); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	go conn.CloseWithReason(4000, "bye")
+
+	// pending message is flushed before the close frame
+	_, data, err := client.ReadMessage()
+	if err != nil || string(data) != "pending" {
+		t.Fatalf("expected pending message, but %s, %v got", data, err)
+	}
+
+	_, _, err = client.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != 4000 || closeErr.Text != "bye" {
+		t.Fatalf("expected close error 4000 bye, but %v got", err)
+	}
+
+	select {
+	case conn := <-closed:
+		if conn.CloseCode() != 4000 || conn.CloseReason() != "bye" {
+			t.Errorf("expected close status 4000 bye, but %d %s got", conn.CloseCode(), conn.CloseReason())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose wasn't called")
+	}
+}
+
+func TestCloseOnConnOpen(t *testing.T) {
+	h, url, _ := newTestServer(t)
+	returned := make(chan time.Duration, 1)
+	h.SetOnConnOpen(func(conn Connection) error {
+		start := time.Now()
+		conn.CloseWithReason(4000, "bye")
+		returned <- time.Since(start)
+		return nil
+	})
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer client.Close()
+
+	// the close frame is sent once the writer started
+	_, _, err = client.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != 4000 || closeErr.Text != "bye" {
+		t.Fatalf("expected close error 4000 bye, but %v got", err)
+	}
+
+	if elapsed := <-returned; elapsed >= CloseGracePeriod {
+		t.Errorf("expected CloseWithReason returned without waiting, but it took %v", elapsed)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	config.Global.Compression.Status = true
+	upgrader.EnableCompression = true
+	defer func() {
+		config.Global.Compression.Status = false
+		upgrader.EnableCompression = false
+	}()
+
+	_, conn, client := newTestConnection(t, &websocket.Dialer{EnableCompression: true})
+
+	data := []byte(strings.Repeat("homey ", 1000))
+	if err := conn.SendMsgContext(context.Background(), data); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	if _, received, err := client.ReadMessage(); err != nil || string(received) != string(data) {
+		t.Fatalf("expected original message, but %v got", err)
+	}
+
+	stats := conn.CompressionStats()
+	if stats.CompressedFrames != 1 {
+		t.Errorf("expected 1 compressed frame, but %d got", stats.CompressedFrames)
+	}
+
+	if ratio := stats.Ratio(); ratio <= 0 || ratio >= 0.5 {
+		t.Errorf("expected compression ratio below 0.5, but %f got", ratio)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	config.Global.Connection.IdleTimeout = 50 * time.Millisecond
+
+	_, conn, client := newTestConnection(t, websocket.DefaultDialer)
+	defer func() {
+		// the timeout watcher reads the config until the connection closed
+		for deadline := time.Now().Add(time.Second); conn.State() != StateClosed && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		config.Global.Connection.IdleTimeout = 0
+	}()
+
+	_, _, err := client.ReadMessage()
+	if !websocket.IsCloseError(err, CloseIdleTimeout) {
+		t.Errorf("expected close code %d, but %v got", CloseIdleTimeout, err)
+	}
+}
+
+func TestPollByPriority(t *testing.T) {
+	c := &connection{}
+	for priority := range c.sendLanes {
+		c.sendLanes[priority] = make(chan *outMsg, 2)
+	}
+
+	for _, priority := range []Priority{PriorityBulk, PriorityNormal, PriorityControl, PriorityNormal} {
+		c.sendLanes[priority] <- &outMsg{priority: priority}
+	}
+
+	for _, expected := range []Priority{PriorityControl, PriorityNormal, PriorityNormal, PriorityBulk} {
+		msg, ok := c.poll(priorityCount)
+		if !ok || msg.priority != expected {
+			t.Fatalf("expected message of priority %d polled", expected)
+		}
+	}
+
+	if _, ok := c.poll(priorityCount); ok {
+		t.Error("expected empty queue")
+	}
+}
+
+func TestStateTransitions(t *testing.T) {
+	h, conn, client := newTestConnection(t, websocket.DefaultDialer)
+	if conn.State() != StateOpen {
+		t.Fatalf("expected state %s, but %s got", StateOpen, conn.State())
+	}
+
+	type transition struct{ from, to ConnState }
+	connChanges := make(chan transition, 4)
+	serverChanges := make(chan transition, 4)
+	conn.OnStateChange(func(_ Connection, from, to ConnState) { connChanges <- transition{from, to} })
+	h.OnStateChange(func(_ Connection, from, to ConnState) { serverChanges <- transition{from, to} })
+
+	go client.ReadMessage()
+	conn.Close()
+
+	for _, changes := range []chan transition{connChanges, serverChanges} {
+		for _, expected := range []transition{{StateOpen, StateClosing}, {StateClosing, StateClosed}} {
+			select {
+			case got := <-changes:
+				if got != expected {
+					t.Errorf("expected %s -> %s, but %s -> %s got", expected.from, expected.to, got.from, got.to)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected %s -> %s", expected.from, expected.to)
+			}
+		}
+	}
+
+	if conn.State() != StateClosed {
+		t.Errorf("expected state %s, but %s got", StateClosed, conn.State())
+	}
+}
+
+type failingRouter struct {
+	BaseRouter
+}
+
+func (fr *failingRouter) Handle(request Request) error {
+	return errors.New("handle failed")
+}
+
+func TestConnStats(t *testing.T) {
+	h, conn, client := newTestConnection(t, websocket.DefaultDialer)
+	h.AddRouter(0, &failingRouter{})
+
+	if err := client.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("write message error: %v", err)
+	}
+	if err := conn.SendMsg([]byte("world")); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+	if _, _, err := client.ReadMessage(); err != nil {
+		t.Fatalf("read message error: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for conn.Stats().HandlerErrors == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := conn.Stats()
+	if stats.FramesIn != 1 || stats.BytesIn != 5 || stats.FramesOut != 1 || stats.BytesOut != 5 || stats.HandlerErrors != 1 {
+		t.Errorf("unexpected connection stats: %+v", stats)
+	}
+
+	serverStats := h.ConnectionStats(nil)
+	if serverStats.Total.Connections != 1 || serverStats.Total.FramesIn != 1 || serverStats.Connections[0].ConnID != conn.GetID() {
+		t.Errorf("unexpected server stats: %+v", serverStats)
+	}
+
+	if filtered := h.ConnectionStats(func(stats ConnStats) bool { return stats.UserID == "nobody" }); filtered.Total.Connections != 0 {
+		t.Errorf("expected no connection of user, but %d got", filtered.Total.Connections)
+	}
+}
+
+type echoRouter struct {
+	BaseRouter
+}
+
+func (er *echoRouter) Handle(request Request) error {
+	return request.Reply(request.GetMsgData())
+}
+
+func TestMixedFrameTypes(t *testing.T) {
+	config.Global.Message.Format = FormatMixed
+	defer func() { config.Global.Message.Format = FormatText }()
+
+	h, conn, client := newTestConnection(t, websocket.DefaultDialer)
+	h.AddRouter(0, &echoRouter{})
+
+	for _, frameType := range []int{websocket.BinaryMessage, websocket.TextMessage} {
+		if err := client.WriteMessage(frameType, []byte("echo")); err != nil {
+			t.Fatalf("write message error: %v", err)
+		}
+
+		messageType, _, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read message error: %v", err)
+		}
+		if messageType != frameType {
+			t.Errorf("expected reply of frame type %d, but %d got", frameType, messageType)
+		}
+	}
+
+	if err := conn.SendBinary([]byte("binary")); err != nil {
+		t.Fatalf("send binary error: %v", err)
+	}
+	if messageType, _, err := client.ReadMessage(); err != nil || messageType != websocket.BinaryMessage {
+		t.Errorf("expected binary frame, but %d got, error: %v", messageType, err)
+	}
+
+	if err := conn.SendMsgWithFrameType([]byte("ping"), websocket.PingMessage); err == nil {
+		t.Error("expected error on invalid frame type")
+	}
+}
+
+func TestHeartbeatRequiresDataType(t *testing.T) {
+	heartbeat, dataType, tlvType := config.Global.Connection.Heartbeat, config.Global.Connection.HeartbeatDataType, config.Global.TLV.Type
+	defer func() {
+		config.Global.Connection.Heartbeat, config.Global.Connection.HeartbeatDataType, config.Global.TLV.Type = heartbeat, dataType, tlvType
+	}()
+
+	config.Global.Connection.Heartbeat = true
+	c := &connection{}
+	msg := NewMessage(0, []byte("hello"))
+
+	config.Global.TLV.Type = false
+	if c.handleHeartbeat(msg, websocket.TextMessage) {
+		t.Error("expected message without tlv type not taken as heartbeat")
+	}
+
+	config.Global.TLV.Type = true
+	config.Global.Connection.HeartbeatDataType = 0
+	if c.handleHeartbeat(msg, websocket.TextMessage) {
+		t.Error("expected message of data type 0 not taken as heartbeat")
+	}
+}
+
+func TestSendWhileClosing(t *testing.T) {
+	gracePeriod := CloseGracePeriod
+	CloseGracePeriod = 500 * time.Millisecond
+	defer func() { CloseGracePeriod = gracePeriod }()
+
+	_, conn, _ := newTestConnection(t, websocket.DefaultDialer)
+
+	// client doesn't answer the close frame, so the connection stays closing for the grace period
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	defer func() { <-closed }()
+	deadline := time.Now().Add(time.Second)
+	for conn.State() != StateClosing && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := conn.SendMsg([]byte("late")); err == nil {
+		t.Error("expected error on sending to closing connection")
+	}
+
+	done := make(chan error, 1)
+	conn.SendMsgAsync([]byte("late"), func(err error) { done <- err })
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected error on sending to closing connection")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("expected callback called while closing")
+	}
+}
+
+func TestHeartbeatRateLimited(t *testing.T) {
+	heartbeat, dataType, tlvType := config.Global.Connection.Heartbeat, config.Global.Connection.HeartbeatDataType, config.Global.TLV.Type
+	rateLimit := config.Global.RateLimit
+	config.Global.Connection.Heartbeat, config.Global.Connection.HeartbeatDataType, config.Global.TLV.Type = true, 5, true
+	config.Global.RateLimit = config.RateLimit{Status: true, Messages: 1, Burst: 1, Policy: RateLimitPolicyDrop}
+
+	_, conn, client := newTestConnection(t, websocket.DefaultDialer)
+	defer func() {
+		client.UnderlyingConn().Close()
+		for deadline := time.Now().Add(time.Second); conn.State() != StateClosed && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		config.Global.Connection.Heartbeat, config.Global.Connection.HeartbeatDataType, config.Global.TLV.Type = heartbeat, dataType, tlvType
+		config.Global.RateLimit = rateLimit
+	}()
+
+	data, err := Pack(NewMessage(5, []byte("heartbeat")))
+	if err != nil {
+		t.Fatalf("pack message error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.WriteMessage(websocket.BinaryMessage, data); err != nil {
+			t.Fatalf("write message error: %v", err)
+		}
+	}
+
+	if _, _, err := client.ReadMessage(); err != nil {
+		t.Fatalf("read heartbeat error: %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := client.ReadMessage(); err == nil {
+		t.Error("expected heartbeats beyond rate limit dropped")
+	}
+
+	if stats := conn.RateLimitStats(); stats.Dropped != 2 {
+		t.Errorf("expected 2 heartbeats dropped, but %d got", stats.Dropped)
+	}
+}
+
+func TestConnectionLoggers(t *testing.T) {
+	sampling := config.Global.Log.Sampling
+	config.Global.Log.Sampling = config.Sampling{Initial: 2, Thereafter: 3, Tick: time.Minute}
+	defer func() { config.Global.Log.Sampling = sampling }()
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	c := &connection{ID: 7, server: NewHomey(websocket.TextMessage, zap.New(core)), remoteAddr: "10.0.0.1"}
+	c.bindLoggers()
+	c.SetUserID("alice")
+
+	c.Logger().Info("hello")
+	entries := logs.TakeAll()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, but %d got", len(entries))
+	}
+
+	fields := entries[0].ContextMap()
+	expected := map[string]interface{}{
+		"connection":  uint64(7),
+		"remote_addr": "10.0.0.1",
+		"node":        utils.NodeID(),
+		"user":        "alice",
+	}
+	for key, value := range expected {
+		if fields[key] != value {
+			t.Errorf("expected field %s %v, but %v got", key, value, fields[key])
+		}
+	}
+
+	// the first 2 entries of a tick are logged, then every 3rd
+	for i := 0; i < 10; i++ {
+		c.msgLogger.Load().Debug("received message")
+	}
+	entries = logs.TakeAll()
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 sampled entries of 10, but %d got", len(entries))
+	}
+	if entries[0].ContextMap()["user"] != "alice" {
+		t.Errorf("expected per message logs carry user, but %v got", entries[0].ContextMap())
+	}
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+)
+
+// ping payload carries the sending time, so RTT could be measured when pong arrives
+func pingPayload() []byte {
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+func (c *connection) handlePong(appData string) error {
+	c.Conn.SetReadDeadline(time.Now().Add(PongWait))
+
+	sentAt, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil {
+		// pong was sent by client actively, it doesn't answer our ping
+		return nil
+	}
+
+	rtt := time.Since(time.Unix(0, sentAt))
+	c.rtt.Store(int64(rtt))
+	c.msgLogger.Load().Debug("received pong", zap.Duration("rtt", rtt))
+
+	return nil
+}
+
+// heartbeatEnabled tells whether heartbeat messages could be told apart by data type,
+// otherwise every message would be taken as a heartbeat
+func heartbeatEnabled() bool {
+	return config.Global.Connection.Heartbeat && config.Global.TLV.Type && config.Global.Connection.HeartbeatDataType != 0
+}
+
+// handleHeartbeat echoes application level heartbeat back to client in the same frame type,
+// it's for browser clients which can't see websocket ping and pong frames
+func (c *connection) handleHeartbeat(msg Message, frameType int) bool {
+	if !heartbeatEnabled() || msg.GetDataType() != config.Global.Connection.HeartbeatDataType {
+		return false
+	}
+
+	data, err := Pack(msg)
+	if err != nil {
+		c.Logger().Error("failed to pack heartbeat message", zap.String("error", err.Error()))
+		return true
+	}
+
+	if err := c.send(&outMsg{data: data, priority: PriorityControl, frameType: replyFrameType(frameType)}); err != nil {
+		c.Logger().Warn("failed to answer heartbeat message", zap.String("error", err.Error()))
+	}
+
+	return true
+}
+
+func (c *connection) RTT() time.Duration {
+	return time.Duration(c.rtt.Load())
+}
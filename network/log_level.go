@@ -0,0 +1,100 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/towerman1990/homey/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// subsystems whose log level could be changed separately
+const (
+	LogNetwork    = "network"
+	LogDistribute = "distribute"
+	LogHandler    = "handler"
+)
+
+func newLogLevels(l *zap.Logger) map[string]zap.AtomicLevel {
+	initial := zapcore.LevelOf(l.Core())
+	if initial == zapcore.InvalidLevel {
+		initial = zapcore.InfoLevel
+	}
+
+	return map[string]zap.AtomicLevel{
+		LogNetwork:    zap.NewAtomicLevelAt(initial),
+		LogDistribute: zap.NewAtomicLevelAt(initial),
+		LogHandler:    zap.NewAtomicLevelAt(initial),
+	}
+}
+
+func subsystemLogger(l *zap.Logger, subsystem string, levels map[string]zap.AtomicLevel) *zap.Logger {
+	return logger.WithLevel(l.Named(subsystem), levels[subsystem])
+}
+
+// SetLogLevel changes log level of subsystem, or all subsystems if it's empty
+func (h *Homey) SetLogLevel(subsystem string, level zapcore.Level) error {
+	if subsystem == "" {
+		for _, atomicLevel := range h.logLevels {
+			atomicLevel.SetLevel(level)
+		}
+		return nil
+	}
+
+	atomicLevel, ok := h.logLevels[subsystem]
+	if !ok {
+		return fmt.Errorf("log subsystem [%s] not found", subsystem)
+	}
+	atomicLevel.SetLevel(level)
+
+	return nil
+}
+
+func (h *Homey) getLogLevels() map[string]string {
+	levels := make(map[string]string, len(h.logLevels))
+	for subsystem, atomicLevel := range h.logLevels {
+		levels[subsystem] = atomicLevel.String()
+	}
+
+	return levels
+}
+
+// LogLevelHandler returns a handler to get or set log levels at runtime,
+// GET returns levels of all subsystems, PUT with body {"level":"debug"} sets all of them,
+// append ?subsystem=network to get or set a single subsystem
+func (h *Homey) LogLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subsystem := r.URL.Query().Get("subsystem"); subsystem != "" {
+			atomicLevel, ok := h.logLevels[subsystem]
+			if !ok {
+				http.Error(w, fmt.Sprintf("log subsystem [%s] not found", subsystem), http.StatusNotFound)
+				return
+			}
+
+			atomicLevel.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var payload struct {
+				Level *zapcore.Level `json:"level"`
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Level == nil {
+				http.Error(w, "must specify a valid logging level", http.StatusBadRequest)
+				return
+			}
+			h.SetLogLevel("", *payload.Level)
+		default:
+			http.Error(w, "only GET and PUT are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.getLogLevels())
+	})
+}
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLogLevelHandler(t *testing.T) {
+	core, _ := observer.New(zapcore.InfoLevel)
+	h := NewHomey(websocket.TextMessage, zap.New(core))
+	handler := h.LogLevelHandler()
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return recorder
+	}
+
+	expectLevels := func(expected map[string]string) {
+		t.Helper()
+		recorder := serve(http.MethodGet, "/", "")
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("expected status %d, but %d got", http.StatusOK, recorder.Code)
+		}
+
+		var levels map[string]string
+		if err := json.NewDecoder(recorder.Body).Decode(&levels); err != nil {
+			t.Fatalf("decode levels error: %v", err)
+		}
+		for subsystem, level := range expected {
+			if levels[subsystem] != level {
+				t.Errorf("expected level %s of %s, but %s got", level, subsystem, levels[subsystem])
+			}
+		}
+	}
+
+	expectLevels(map[string]string{LogNetwork: "info", LogDistribute: "info", LogHandler: "info"})
+
+	if recorder := serve(http.MethodPut, "/", `{"level":"debug"}`); recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d on setting all levels, but %d got", http.StatusOK, recorder.Code)
+	}
+	expectLevels(map[string]string{LogNetwork: "debug", LogDistribute: "debug", LogHandler: "debug"})
+
+	if recorder := serve(http.MethodPut, "/?subsystem="+LogNetwork, `{"level":"error"}`); recorder.Code != http.StatusOK {
+		t.Fatalf("expected status %d on setting level of subsystem, but %d got", http.StatusOK, recorder.Code)
+	}
+	expectLevels(map[string]string{LogNetwork: "error", LogDistribute: "debug", LogHandler: "debug"})
+
+	for _, test := range []struct {
+		method, target, body string
+
+		code int
+	}{
+		{method: http.MethodGet, target: "/?subsystem=unknown", code: http.StatusNotFound},
+		{method: http.MethodPut, target: "/?subsystem=unknown", body: `{"level":"debug"}`, code: http.StatusNotFound},
+		{method: http.MethodPut, target: "/", body: "debug", code: http.StatusBadRequest},
+		{method: http.MethodPut, target: "/", body: `{"level":"verbose"}`, code: http.StatusBadRequest},
+		{method: http.MethodPut, target: "/", body: `{}`, code: http.StatusBadRequest},
+		{method: http.MethodPost, target: "/", body: `{"level":"debug"}`, code: http.StatusMethodNotAllowed},
+	} {
+		if recorder := serve(test.method, test.target, test.body); recorder.Code != test.code {
+			t.Errorf("%s %s %s: expected status %d, but %d got", test.method, test.target, test.body, test.code, recorder.Code)
+		}
+	}
+
+	// failed requests change nothing
+	expectLevels(map[string]string{LogNetwork: "error", LogDistribute: "debug", LogHandler: "debug"})
+}
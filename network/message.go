@@ -1,14 +1,19 @@
 package network
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/towerman1990/homey/config"
 )
 
-var endian binary.ByteOrder
+var (
+	endian binary.ByteOrder
+
+	ErrPackageTooLarge = errors.New("beyond max package size limit")
+)
 
 type (
 	Message interface {
@@ -36,9 +41,15 @@ type (
 
 		// set message data length
 		SetDataLength(dataLength uint32)
+
+		// get sequence number, 0 if the message isn't reliable
+		GetSeq() uint32
+
+		// set sequence number
+		SetSeq(seq uint32)
 	}
 
-	// message structure: connID->length->type->data
+	// message structure: connID->type->length->seq->data
 	message struct {
 
 		// the ID of connection which is in charge of sending message
@@ -52,6 +63,9 @@ type (
 		// message data length
 		DataLength uint32
 
+		// sequence number of reliable message, or the acknowledged one of ack message
+		Seq uint32
+
 		// message data
 		Data []byte
 	}
@@ -97,11 +111,16 @@ func (m *message) SetDataLength(dataLength uint32) {
 	m.DataLength = dataLength
 }
 
+func (m *message) GetSeq() uint32 {
+	return m.Seq
+}
+
+func (m *message) SetSeq(seq uint32) {
+	m.Seq = seq
+}
+
 func (m *message) GetHeadLength() int8 {
-	if m.connID > 0 {
-		return 4 + 8 + 4 // uint64 connID take 8 byte length
-	}
-	return 4 + 4
+	return int8(headLength(m.connID > 0))
 }
 
 func NewMessage(packageType uint32, data []byte) Message {
@@ -113,71 +132,99 @@ func NewMessage(packageType uint32, data []byte) Message {
 	}
 }
 
+// headLength gets the header length of a package in current TLV config
+func headLength(isForward bool) (length int) {
+	if isForward {
+		length += 8
+	}
+	if config.Global.TLV.Type {
+		length += 4
+	}
+	if config.Global.TLV.Length {
+		length += 4
+	}
+	if config.Global.TLV.Seq {
+		length += 4
+	}
+
+	return
+}
+
+// Pack encodes message into a package, the header is written in place
+// so a package costs a single allocation
 func Pack(message Message) (packageData []byte, err error) {
-	dataBuff := bytes.NewBuffer([]byte{})
+	data := message.GetData()
+	isForward := message.GetConnID() > 0
+	packageData = make([]byte, headLength(isForward)+len(data))
 
-	if message.GetConnID() > 0 {
-		if err := binary.Write(dataBuff, endian, message.GetConnID()); err != nil {
-			return packageData, err
-		}
+	offset := 0
+	if isForward {
+		endian.PutUint64(packageData[offset:], message.GetConnID())
+		offset += 8
 	}
 
 	if config.Global.TLV.Type {
-		if err := binary.Write(dataBuff, endian, message.GetDataType()); err != nil {
-			return packageData, err
-		}
+		endian.PutUint32(packageData[offset:], message.GetDataType())
+		offset += 4
 	}
 
 	if config.Global.TLV.Length {
-		if err := binary.Write(dataBuff, endian, message.GetDataLength()); err != nil {
-			return packageData, err
-		}
+		endian.PutUint32(packageData[offset:], uint32(len(data)))
+		offset += 4
 	}
 
-	if err := binary.Write(dataBuff, endian, message.GetData()); err != nil {
-		return packageData, err
+	if config.Global.TLV.Seq {
+		endian.PutUint32(packageData[offset:], message.GetSeq())
+		offset += 4
 	}
+	copy(packageData[offset:], data)
 
-	packageData = dataBuff.Bytes()
-
-	return packageData, err
+	return
 }
 
+// UnPack decodes a package, data of the message shares memory with binaryData
+// instead of being copied
 func UnPack(binaryData []byte, isForward bool) (Message, error) {
 	message := &message{}
-	dataBuff := bytes.NewBuffer(binaryData)
+	if len(binaryData) < headLength(isForward) {
+		return message, fmt.Errorf("package length [%d] is shorter than header: %w", len(binaryData), io.ErrUnexpectedEOF)
+	}
 
+	offset := 0
 	if isForward {
-		if err := binary.Read(dataBuff, endian, &message.connID); err != nil {
-			return message, err
-		}
+		message.connID = endian.Uint64(binaryData[offset:])
+		offset += 8
 	}
 
 	if config.Global.TLV.Type {
-		if err := binary.Read(dataBuff, endian, &message.DataType); err != nil {
-			return message, err
-		}
+		message.DataType = endian.Uint32(binaryData[offset:])
+		offset += 4
 	}
 
 	if config.Global.TLV.Length {
-		if err := binary.Read(dataBuff, endian, &message.DataLength); err != nil {
-			return message, err
-		}
-	} else {
-		message.DataLength = uint32(len(binaryData))
-		if message.connID != 0 {
-			message.DataLength -= 8
-		}
+		message.DataLength = endian.Uint32(binaryData[offset:])
+		offset += 4
+	}
+
+	if config.Global.TLV.Seq {
+		message.Seq = endian.Uint32(binaryData[offset:])
+		offset += 4
+	}
+
+	// the rest of package is data if it doesn't carry length
+	rest := binaryData[offset:]
+	if !config.Global.TLV.Length {
+		message.DataLength = uint32(len(rest))
 	}
 
 	if config.Global.MaxPackageSize > 0 && message.DataLength > config.Global.MaxPackageSize {
-		return message, fmt.Errorf("message data length [%d] beyond max package size limit", message.DataLength)
+		return message, fmt.Errorf("message data length [%d] %w", message.DataLength, ErrPackageTooLarge)
 	}
 
-	message.Data = make([]byte, message.DataLength)
-	if err := binary.Read(dataBuff, endian, &message.Data); err != nil {
-		return message, err
+	if int(message.DataLength) > len(rest) {
+		return message, fmt.Errorf("message data length [%d] is beyond package: %w", message.DataLength, io.ErrUnexpectedEOF)
 	}
+	message.Data = rest[:message.DataLength:message.DataLength]
 
 	return message, nil
 }
@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/towerman1990/homey/config"
-	log "github.com/towerman1990/homey/logger"
 	"go.uber.org/zap"
 )
 
@@ -22,6 +21,9 @@ type (
 		// send message to task queue, the message would be handled by worker
 		SendMsgToTaskQueue(Request)
 
+		// get how many requests are waiting in each worker's task queue
+		GetTaskQueueDepths() []int
+
 		String()
 	}
 
@@ -31,6 +33,8 @@ type (
 		TaskQueue []chan Request
 
 		WorkerPoolSize uint32
+
+		logger *zap.Logger
 	}
 )
 
@@ -38,33 +42,41 @@ func (mh *messageHandler) ExecHandler(request Request) {
 	dataType := request.GetMsgDataType()
 	handler, ok := mh.Handlers[dataType]
 	if !ok {
-		log.Logger.Warn("data type hasn't been bound on handler", zap.Uint32("dataType", dataType))
+		mh.requestLogger(request).Warn("data type hasn't been bound on handler", zap.Uint32("dataType", dataType))
 		return
 	}
 
 	if err := handler.PreHandle(request); err != nil {
-		log.Logger.Error("failed to execute PreHandle function", zap.String("error", err.Error()))
+		countHandlerError(request)
+		mh.requestLogger(request).Error("failed to execute PreHandle function", zap.Uint32("dataType", dataType), zap.String("error", err.Error()))
 		return
 	}
 
 	if err := handler.Handle(request); err != nil {
-		log.Logger.Error("failed to execute PreHandle function", zap.String("error", err.Error()))
+		countHandlerError(request)
+		mh.requestLogger(request).Error("failed to execute Handle function", zap.Uint32("dataType", dataType), zap.String("error", err.Error()))
 		return
 	}
 
 	if err := handler.PostHandle(request); err != nil {
-		log.Logger.Error("failed to execute PreHandle function", zap.String("error", err.Error()))
+		countHandlerError(request)
+		mh.requestLogger(request).Error("failed to execute PostHandle function", zap.Uint32("dataType", dataType), zap.String("error", err.Error()))
 		return
 	}
 }
 
+func (mh *messageHandler) requestLogger(request Request) *zap.Logger {
+	conn := request.GetConnection()
+	return mh.logger.With(zap.Uint64("connection", conn.GetID()), zap.String("user", conn.GetUserID()))
+}
+
 func (mh *messageHandler) AddRouter(dataType uint32, router Router) {
 	if _, ok := mh.Handlers[dataType]; ok {
-		log.Logger.Error("the data type has been added", zap.Uint32("dataType", dataType))
+		mh.logger.Error("the data type has been added", zap.Uint32("dataType", dataType))
 	}
 
 	mh.Handlers[dataType] = router
-	log.Logger.Info("added router successfully", zap.Uint32("dataType", dataType))
+	mh.logger.Info("added router successfully", zap.Uint32("dataType", dataType))
 }
 
 func (mh *messageHandler) StartWorkPool() {
@@ -75,7 +87,7 @@ func (mh *messageHandler) StartWorkPool() {
 }
 
 func (mh *messageHandler) StartOneWork(i int) {
-	log.Logger.Info("new worker started", zap.Int("workerID", i))
+	mh.logger.Info("new worker started", zap.Int("workerID", i))
 
 	for request := range mh.TaskQueue[i] {
 		mh.ExecHandler(request)
@@ -87,14 +99,24 @@ func (mh *messageHandler) SendMsgToTaskQueue(request Request) {
 	mh.TaskQueue[workerID] <- request
 }
 
+func (mh *messageHandler) GetTaskQueueDepths() []int {
+	depths := make([]int, len(mh.TaskQueue))
+	for i, queue := range mh.TaskQueue {
+		depths[i] = len(queue)
+	}
+
+	return depths
+}
+
 func (mh *messageHandler) String() {
 	fmt.Printf("mh.Handlers: %v\n", mh.Handlers)
 }
 
-func NewMessageHandler() MessageHandler {
+func NewMessageHandler(logger *zap.Logger) MessageHandler {
 	return &messageHandler{
+		logger:         logger,
 		Handlers:       make(map[uint32]Router),
 		WorkerPoolSize: config.Global.WorkerPoolSize,
-		TaskQueue:      make([]chan Request, config.Global.MaxWorkerTaskLen),
+		TaskQueue:      make([]chan Request, config.Global.WorkerPoolSize),
 	}
 }
@@ -1,7 +1,10 @@
 package network
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"testing"
 
 	"github.com/towerman1990/homey/config"
@@ -58,3 +61,99 @@ func TestPackAndUnPackData(t *testing.T) {
 		t.Logf("message content: %s", message.GetData())
 	}
 }
+
+func TestUnPackTruncated(t *testing.T) {
+	tlv := config.Global.TLV
+	config.Global.TLV.Type, config.Global.TLV.Length = true, true
+	defer func() { config.Global.TLV = tlv }()
+
+	packageData, err := Pack(NewMessage(1, []byte("Hello World!")))
+	if err != nil {
+		t.Fatalf("pack message error: %v", err)
+	}
+
+	for _, size := range []int{4, len(packageData) - 1} {
+		if _, err := UnPack(packageData[:size], false); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected %v on %d bytes, but %v got", io.ErrUnexpectedEOF, size, err)
+		}
+	}
+}
+
+// benchmarks pack and unpack a 1KB payload with type and length in the header
+func benchmarkPayload(b *testing.B) []byte {
+	tlv := config.Global.TLV
+	config.Global.TLV.Type, config.Global.TLV.Length = true, true
+	b.Cleanup(func() { config.Global.TLV = tlv })
+
+	return bytes.Repeat([]byte("homey"), 200)
+}
+
+func BenchmarkPack(b *testing.B) {
+	message := NewMessage(1, benchmarkPayload(b))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Pack(message); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnPack(b *testing.B) {
+	packageData, err := Pack(NewMessage(1, benchmarkPayload(b)))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := UnPack(packageData, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadAll reads frames the way websocket.Conn.ReadMessage does
+func BenchmarkReadAll(b *testing.B) {
+	packageData, err := Pack(NewMessage(1, benchmarkPayload(b)))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		binaryMessage, err := io.ReadAll(bytes.NewReader(packageData))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := UnPack(binaryMessage, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadPooled reads frames the way connection reader does
+func BenchmarkReadPooled(b *testing.B) {
+	packageData, err := Pack(NewMessage(1, benchmarkPayload(b)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	reader := bytes.NewReader(packageData)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(packageData)
+		buf, err := readPooled(reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		msg, err := UnPack(buf.Bytes(), false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg.SetData(append([]byte(nil), msg.GetData()...))
+		putBuffer(buf)
+	}
+}
@@ -0,0 +1,123 @@
+package network
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/towerman1990/homey/config"
+	"github.com/towerman1990/homey/distribute"
+	"github.com/towerman1990/homey/utils"
+	"go.uber.org/zap"
+)
+
+// multicast envelope structure: count->connIDs->package data
+func packMulticast(connIDs []uint64, data []byte) []byte {
+	envelope := make([]byte, 4+8*len(connIDs)+len(data))
+	endian.PutUint32(envelope, uint32(len(connIDs)))
+	for i, connID := range connIDs {
+		endian.PutUint64(envelope[4+8*i:], connID)
+	}
+	copy(envelope[4+8*len(connIDs):], data)
+
+	return envelope
+}
+
+func unpackMulticast(envelope []byte) (connIDs []uint64, data []byte, err error) {
+	if len(envelope) < 4 {
+		return connIDs, data, fmt.Errorf("multicast envelope length [%d] is too short", len(envelope))
+	}
+
+	count := int(endian.Uint32(envelope))
+	if len(envelope) < 4+8*count {
+		return connIDs, data, fmt.Errorf("multicast envelope length [%d] is too short for [%d] connections", len(envelope), count)
+	}
+
+	connIDs = make([]uint64, count)
+	for i := range connIDs {
+		connIDs[i] = endian.Uint64(envelope[4+8*i:])
+	}
+	data = envelope[4+8*count:]
+
+	return
+}
+
+// sendToLocalConns never waits for a slow connection, or it would stall the others
+func (h *Homey) sendToLocalConns(connIDs []uint64, data []byte) {
+	for _, connID := range connIDs {
+		conn, err := h.ConnManager.Get(connID)
+		if err != nil {
+			// the connection may be dropped and waiting for resuming
+			if s := h.sessions.getByConnID(connID); s != nil {
+				s.send(data)
+			}
+			continue
+		}
+
+		if err := conn.TrySendMsg(data); err != nil {
+			h.logger.Warn("failed to send multicast message", zap.Uint64("connection", connID), zap.String("error", err.Error()))
+		}
+	}
+}
+
+// groupByNode groups connIDs by the node which generated them
+func groupByNode(connIDs []uint64) map[uint16][]uint64 {
+	groups := make(map[uint16][]uint64)
+	for _, connID := range connIDs {
+		nodeID := utils.NodeIDOf(connID)
+		groups[nodeID] = append(groups[nodeID], connID)
+	}
+
+	return groups
+}
+
+// Multicast sends msg to every connection in connIDs, the connections are grouped
+// by the node they belong to, so only one envelope is published for each remote
+// node and the connections of current node are delivered without the broker
+func (h *Homey) Multicast(connIDs []uint64, msg Message) (err error) {
+	data, err := Pack(msg)
+	if err != nil {
+		return
+	}
+
+	localNodeID := utils.NodeID()
+	groups := groupByNode(connIDs)
+
+	h.sendToLocalConns(groups[localNodeID], data)
+	delete(groups, localNodeID)
+
+	if !config.Global.Distribute.Status {
+		return
+	}
+
+	for nodeID, nodeConnIDs := range groups {
+		if e := distribute.PublishNodeMsg(h.ctx, nodeID, packMulticast(nodeConnIDs, data)); e != nil {
+			h.distLogger.Error("failed to publish multicast message", zap.Uint16("node", nodeID), zap.String("error", e.Error()))
+			err = e
+		}
+	}
+
+	return
+}
+
+// SubscribeNodeChannel receives multicast envelopes sent to current node
+func (h *Homey) SubscribeNodeChannel() {
+	rdb := distribute.GetRedisClient()
+	pubsub := rdb.Subscribe(h.ctx, distribute.NodeChannel(utils.NodeID()))
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		envelope, err := base64.StdEncoding.DecodeString(msg.Payload)
+		if err != nil {
+			h.distLogger.Error("failed to base64 decode multicast envelope", zap.String("error", err.Error()))
+			continue
+		}
+
+		connIDs, data, err := unpackMulticast(envelope)
+		if err != nil {
+			h.distLogger.Error("failed to unpack multicast envelope", zap.String("error", err.Error()))
+			continue
+		}
+
+		h.sendToLocalConns(connIDs, data)
+	}
+}
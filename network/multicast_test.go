@@ -0,0 +1,87 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/towerman1990/homey/utils"
+)
+
+func TestPackAndUnPackMulticast(t *testing.T) {
+	const content = "Hello World!"
+	connIDs := []uint64{1, 2, 1 << 40}
+
+	envelope := packMulticast(connIDs, []byte(content))
+	gotConnIDs, data, err := unpackMulticast(envelope)
+	if err != nil {
+		t.Fatalf("unpack multicast envelope error: %v", err)
+	}
+
+	if len(gotConnIDs) != len(connIDs) {
+		t.Fatalf("expected %d connections, but %d got", len(connIDs), len(gotConnIDs))
+	}
+
+	for i := range connIDs {
+		if gotConnIDs[i] != connIDs[i] {
+			t.Errorf("expected connection %d, but %d got", connIDs[i], gotConnIDs[i])
+		}
+	}
+
+	if string(data) != content {
+		t.Errorf("expected data %s, but %s got", content, data)
+	}
+
+	if _, _, err := unpackMulticast(envelope[:10]); err == nil {
+		t.Error("expected error on truncated envelope")
+	}
+}
+
+func TestGroupByNode(t *testing.T) {
+	// machine ID is the low 16 bits, the sequence is above it
+	local := uint64(utils.NodeID())
+	remote := uint64(utils.NodeID() + 1)
+	groups := groupByNode([]uint64{local, remote, local | 1<<16})
+
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 nodes, but %d got", len(groups))
+	}
+	if ids := groups[utils.NodeID()]; len(ids) != 2 || ids[0] != local || ids[1] != local|1<<16 {
+		t.Errorf("expected 2 connections of local node, but %v got", ids)
+	}
+	if ids := groups[utils.NodeID()+1]; len(ids) != 1 || ids[0] != remote {
+		t.Errorf("expected 1 connection of remote node, but %v got", ids)
+	}
+}
+
+func TestMulticastLocal(t *testing.T) {
+	h, conn, client := newTestConnection(t, websocket.DefaultDialer)
+
+	// a local connection whose writer never drains the full queue
+	slow := newQueueTestConnection()
+	slow.ID = uint64(utils.NodeID()) | 1<<16
+	slow.sendLanes[PriorityNormal] <- &outMsg{data: []byte("pending"), priority: PriorityNormal}
+	h.ConnManager.Add(slow)
+	defer slow.cancel()
+
+	start := time.Now()
+	if err := h.Multicast([]uint64{slow.ID, conn.GetID()}, NewMessage(0, []byte("hello"))); err != nil {
+		t.Fatalf("multicast error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected multicast not to wait for slow connection, but it took %v", elapsed)
+	}
+
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("read message error: %v", err)
+	}
+	if !strings.HasSuffix(string(data), "hello") {
+		t.Errorf("expected hello, but %s got", data)
+	}
+
+	if dropped := slow.dropped.Load(); dropped != 1 {
+		t.Errorf("expected 1 message dropped by slow connection, but %d got", dropped)
+	}
+}
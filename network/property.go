@@ -0,0 +1,77 @@
+package network
+
+// PropertyObserver is called after a property changed, newValue is nil if it was deleted
+type PropertyObserver func(conn Connection, key string, oldValue, newValue interface{})
+
+func (c *connection) SetProperty(key string, value interface{}) {
+	c.propertyLock.Lock()
+	oldValue := c.properties[key]
+	c.properties[key] = value
+	observers := c.propertyObservers
+	c.propertyLock.Unlock()
+
+	for _, observer := range observers {
+		observer(c, key, oldValue, value)
+	}
+}
+
+func (c *connection) GetProperty(key string) (value interface{}, ok bool) {
+	c.propertyLock.RLock()
+	defer c.propertyLock.RUnlock()
+
+	value, ok = c.properties[key]
+	return
+}
+
+func (c *connection) DeleteProperty(key string) {
+	c.propertyLock.Lock()
+	oldValue, ok := c.properties[key]
+	delete(c.properties, key)
+	observers := c.propertyObservers
+	c.propertyLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, observer := range observers {
+		observer(c, key, oldValue, nil)
+	}
+}
+
+// RangeProperties iterates over a snapshot, so f is free to modify properties
+func (c *connection) RangeProperties(f func(key string, value interface{}) bool) {
+	c.propertyLock.RLock()
+	properties := make(map[string]interface{}, len(c.properties))
+	for key, value := range c.properties {
+		properties[key] = value
+	}
+	c.propertyLock.RUnlock()
+
+	for key, value := range properties {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+func (c *connection) OnPropertyChange(observer PropertyObserver) {
+	c.propertyLock.Lock()
+	defer c.propertyLock.Unlock()
+
+	// copy on write, so observers could be called without holding the lock
+	observers := make([]PropertyObserver, len(c.propertyObservers), len(c.propertyObservers)+1)
+	copy(observers, c.propertyObservers)
+	c.propertyObservers = append(observers, observer)
+}
+
+// GetAs gets a property of conn as type T, ok is false if it's absent or of another type
+func GetAs[T any](conn Connection, key string) (value T, ok bool) {
+	property, exist := conn.GetProperty(key)
+	if !exist {
+		return
+	}
+
+	value, ok = property.(T)
+	return
+}
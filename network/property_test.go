@@ -0,0 +1,44 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestProperties(t *testing.T) {
+	conn := &connection{properties: make(map[string]interface{})}
+
+	var changes []string
+	conn.OnPropertyChange(func(conn Connection, key string, oldValue, newValue interface{}) {
+		changes = append(changes, key)
+	})
+
+	conn.SetProperty("level", 3)
+	conn.SetProperty("name", "homey")
+
+	if level, ok := GetAs[int](conn, "level"); !ok || level != 3 {
+		t.Errorf("expected level 3, but %d, %v got", level, ok)
+	}
+
+	if _, ok := GetAs[string](conn, "level"); ok {
+		t.Error("expected failure on getting int property as string")
+	}
+
+	var count int
+	conn.RangeProperties(func(key string, value interface{}) bool {
+		count++
+		return true
+	})
+	if count != 2 {
+		t.Errorf("expected 2 properties, but %d got", count)
+	}
+
+	conn.DeleteProperty("name")
+	conn.DeleteProperty("absent")
+	if _, ok := conn.GetProperty("name"); ok {
+		t.Error("expected name to be deleted")
+	}
+
+	if len(changes) != 3 {
+		t.Errorf("expected 3 change notifications, but %d got", len(changes))
+	}
+}
@@ -0,0 +1,213 @@
+package network
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+)
+
+// policies applied when a connection exceeds the inbound rate limit
+const (
+	RateLimitPolicyDrop       = "drop"
+	RateLimitPolicyDelay      = "delay"
+	RateLimitPolicyError      = "error"
+	RateLimitPolicyDisconnect = "disconnect"
+)
+
+type (
+	RateLimitStats struct {
+		// messages beyond the limit
+		Limited uint64 `json:"limited"`
+
+		// messages dropped or answered with an error
+		Dropped uint64 `json:"dropped"`
+
+		// messages handled after waiting for tokens
+		Delayed uint64 `json:"delayed"`
+	}
+
+	tokenBucket struct {
+		// tokens added per second
+		rate float64
+
+		burst float64
+
+		tokens float64
+
+		last time.Time
+	}
+
+	// rateLimiter is only used by the reader of a connection, so the buckets needn't lock
+	rateLimiter struct {
+		messages *tokenBucket
+
+		bytes *tokenBucket
+
+		dataTypes map[uint32]*tokenBucket
+
+		limited atomic.Uint64
+
+		dropped atomic.Uint64
+
+		delayed atomic.Uint64
+	}
+)
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	burst := rate * config.Global.RateLimit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// get how long to wait until n tokens are available
+func (tb *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if tb == nil {
+		return 0
+	}
+
+	tb.refill(now)
+	if tb.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// take n tokens, the bucket goes into debt if there aren't enough
+func (tb *tokenBucket) take(n float64) {
+	if tb != nil {
+		tb.tokens -= n
+	}
+}
+
+func newRateLimiter() *rateLimiter {
+	if !config.Global.RateLimit.Status {
+		return nil
+	}
+
+	rl := &rateLimiter{
+		messages:  newTokenBucket(config.Global.RateLimit.Messages),
+		bytes:     newTokenBucket(config.Global.RateLimit.Bytes),
+		dataTypes: make(map[uint32]*tokenBucket),
+	}
+
+	for dataType, rate := range config.Global.RateLimit.DataTypes {
+		if bucket := newTokenBucket(rate); bucket != nil {
+			rl.dataTypes[dataType] = bucket
+		}
+	}
+
+	return rl
+}
+
+// get how long the message has to wait for all the buckets
+func (rl *rateLimiter) wait(dataType uint32, size int) (wait time.Duration) {
+	now := time.Now()
+	for _, w := range []time.Duration{
+		rl.messages.wait(1, now),
+		rl.bytes.wait(float64(size), now),
+		rl.dataTypes[dataType].wait(1, now),
+	} {
+		if w > wait {
+			wait = w
+		}
+	}
+
+	return
+}
+
+func (rl *rateLimiter) take(dataType uint32, size int) {
+	rl.messages.take(1)
+	rl.bytes.take(float64(size))
+	rl.dataTypes[dataType].take(1)
+}
+
+// rateLimitErrorEnabled tells whether clients could tell the error message apart from
+// application messages by data type, otherwise error policy drops messages like drop policy
+func rateLimitErrorEnabled() bool {
+	return config.Global.TLV.Type && config.Global.RateLimit.ErrorDataType != 0
+}
+
+// allowMsg applies rate limit to an inbound message, it returns false if the message shouldn't be handled
+func (c *connection) allowMsg(msg Message, size int) bool {
+	rl := c.rateLimiter
+	if rl == nil {
+		return true
+	}
+
+	wait := rl.wait(msg.GetDataType(), size)
+	if wait == 0 {
+		rl.take(msg.GetDataType(), size)
+		return true
+	}
+	rl.limited.Add(1)
+
+	switch config.Global.RateLimit.Policy {
+	case RateLimitPolicyDelay:
+		rl.delayed.Add(1)
+		rl.take(msg.GetDataType(), size)
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-c.ctx.Done():
+			return false
+		}
+	case RateLimitPolicyError:
+		rl.dropped.Add(1)
+		if !rateLimitErrorEnabled() {
+			c.msgLogger.Load().Debug("drop message beyond rate limit", zap.Uint32("dataType", msg.GetDataType()))
+			break
+		}
+
+		data, err := Pack(NewMessage(config.Global.RateLimit.ErrorDataType, []byte("rate limit exceeded")))
+		if err == nil {
+			err = c.SendMsg(data)
+		}
+
+		if err != nil {
+			c.Logger().Warn("failed to send rate limit error", zap.String("error", err.Error()))
+		}
+	case RateLimitPolicyDisconnect:
+		rl.dropped.Add(1)
+		c.msgLogger.Load().Warn("disconnect connection beyond rate limit")
+		go c.CloseWithReason(websocket.ClosePolicyViolation, "rate limit exceeded")
+	default:
+		rl.dropped.Add(1)
+		c.msgLogger.Load().Debug("drop message beyond rate limit", zap.Uint32("dataType", msg.GetDataType()))
+	}
+
+	return false
+}
+
+func (c *connection) RateLimitStats() (stats RateLimitStats) {
+	if c.rateLimiter == nil {
+		return
+	}
+
+	return RateLimitStats{
+		Limited: c.rateLimiter.limited.Load(),
+		Dropped: c.rateLimiter.dropped.Load(),
+		Delayed: c.rateLimiter.delayed.Load(),
+	}
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/towerman1990/homey/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := &tokenBucket{rate: 10, burst: 2, tokens: 2, last: time.Now()}
+	now := bucket.last
+
+	for i := 0; i < 2; i++ {
+		if wait := bucket.wait(1, now); wait != 0 {
+			t.Fatalf("expected burst token available, but wait %v got", wait)
+		}
+		bucket.take(1)
+	}
+
+	if wait := bucket.wait(1, now); wait != 100*time.Millisecond {
+		t.Errorf("expected wait 100ms on empty bucket, but %v got", wait)
+	}
+
+	if wait := bucket.wait(1, now.Add(100*time.Millisecond)); wait != 0 {
+		t.Errorf("expected token refilled after 100ms, but wait %v got", wait)
+	}
+
+	// tokens never exceed burst
+	if bucket.refill(now.Add(time.Hour)); bucket.tokens != bucket.burst {
+		t.Errorf("expected %f tokens, but %f got", bucket.burst, bucket.tokens)
+	}
+
+	var unlimited *tokenBucket
+	if wait := unlimited.wait(1, now); wait != 0 {
+		t.Errorf("expected no wait without limit, but %v got", wait)
+	}
+}
+
+func TestRateLimitPolicies(t *testing.T) {
+	rateLimit, tlvType := config.Global.RateLimit, config.Global.TLV.Type
+	defer func() { config.Global.RateLimit, config.Global.TLV.Type = rateLimit, tlvType }()
+
+	for _, test := range []struct {
+		policy string
+
+		tlvType bool
+
+		errorDataType uint32
+
+		// the message is handled after waiting
+		allowed bool
+
+		stats RateLimitStats
+
+		// an error message is sent to client
+		errorSent bool
+
+		closeCode int
+	}{
+		{policy: RateLimitPolicyDrop, stats: RateLimitStats{Limited: 1, Dropped: 1}},
+		{policy: RateLimitPolicyDelay, allowed: true, stats: RateLimitStats{Limited: 1, Delayed: 1}},
+		{policy: RateLimitPolicyError, tlvType: true, errorDataType: 9, stats: RateLimitStats{Limited: 1, Dropped: 1}, errorSent: true},
+		{policy: RateLimitPolicyError, tlvType: false, errorDataType: 9, stats: RateLimitStats{Limited: 1, Dropped: 1}},
+		{policy: RateLimitPolicyError, tlvType: true, errorDataType: 0, stats: RateLimitStats{Limited: 1, Dropped: 1}},
+		{policy: RateLimitPolicyDisconnect, stats: RateLimitStats{Limited: 1, Dropped: 1}, closeCode: websocket.ClosePolicyViolation},
+	} {
+		config.Global.RateLimit.Policy = test.policy
+		config.Global.TLV.Type = test.tlvType
+		config.Global.RateLimit.ErrorDataType = test.errorDataType
+
+		c := newQueueTestConnection()
+		// an empty bucket, the next token comes in 20ms
+		c.rateLimiter = &rateLimiter{
+			messages:  &tokenBucket{rate: 50, burst: 1, last: time.Now()},
+			dataTypes: make(map[uint32]*tokenBucket),
+		}
+
+		if allowed := c.allowMsg(NewMessage(1, []byte("hello")), 5); allowed != test.allowed {
+			t.Errorf("%s: expected allowed %t, but %t got", test.policy, test.allowed, allowed)
+		}
+
+		if stats := c.RateLimitStats(); stats != test.stats {
+			t.Errorf("%s: expected stats %+v, but %+v got", test.policy, test.stats, stats)
+		}
+
+		msg, sent := c.poll(priorityCount)
+		if sent != test.errorSent {
+			t.Errorf("%s: expected error sent %t, but %t got", test.policy, test.errorSent, sent)
+		}
+		if sent {
+			if errMsg, err := UnPack(msg.data, false); err != nil || errMsg.GetDataType() != test.errorDataType {
+				t.Errorf("%s: expected error message of data type %d", test.policy, test.errorDataType)
+			}
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for c.CloseCode() != test.closeCode && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if c.CloseCode() != test.closeCode {
+			t.Errorf("%s: expected close code %d, but %d got", test.policy, test.closeCode, c.CloseCode())
+		}
+		c.cancel()
+	}
+}
+
+func TestRateLimitDelayCancelled(t *testing.T) {
+	policy := config.Global.RateLimit.Policy
+	config.Global.RateLimit.Policy = RateLimitPolicyDelay
+	defer func() { config.Global.RateLimit.Policy = policy }()
+
+	c := newQueueTestConnection()
+	c.rateLimiter = &rateLimiter{
+		messages:  &tokenBucket{rate: 0.1, burst: 1, last: time.Now()},
+		dataTypes: make(map[uint32]*tokenBucket),
+	}
+
+	c.ctx, c.cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer c.cancel()
+
+	// the connection is closed while waiting for tokens
+	if c.allowMsg(NewMessage(1, nil), 0) {
+		t.Error("expected message of closed connection not handled")
+	}
+}
@@ -0,0 +1,176 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrReliableDisabled = errors.New("reliable delivery is disabled")
+
+	ErrRetentionFull = errors.New("too many unacknowledged messages")
+)
+
+type (
+	// reliableWindow keeps reliable messages until client acknowledges them
+	reliableWindow struct {
+		// sequence number of the last pushed message
+		seq uint32
+
+		// unacknowledged messages in order of sequence number
+		pending []*reliableMsg
+
+		lock sync.Mutex
+	}
+
+	reliableMsg struct {
+		seq uint32
+
+		data []byte
+
+		sentAt time.Time
+	}
+)
+
+// reliableEnabled tells whether reliable delivery could work, acks are told apart by
+// data type, so data type 0 of the default route or messages without type can't be acks,
+// and unacknowledged messages are only retransmitted on resuming a session
+func reliableEnabled() bool {
+	return config.Global.Reliable.Status && sessionEnabled() && config.Global.TLV.Seq && config.Global.Reliable.AckDataType != 0
+}
+
+// newReliableWindow returns nil if reliable delivery is disabled
+func newReliableWindow() *reliableWindow {
+	if !reliableEnabled() {
+		return nil
+	}
+
+	return &reliableWindow{}
+}
+
+// push assigns the next sequence number to msg and keeps the packed data until it's acknowledged
+func (rw *reliableWindow) push(msg Message) (data []byte, err error) {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	rw.prune(time.Now())
+	if len(rw.pending) >= config.Global.Reliable.RetentionSize {
+		return nil, ErrRetentionFull
+	}
+
+	msg.SetSeq(rw.seq + 1)
+	if data, err = Pack(msg); err != nil {
+		return
+	}
+
+	rw.seq++
+	rw.pending = append(rw.pending, &reliableMsg{seq: rw.seq, data: data, sentAt: time.Now()})
+
+	return
+}
+
+// ack removes messages up to seq, acknowledgements are cumulative
+func (rw *reliableWindow) ack(seq uint32) {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	i := 0
+	for i < len(rw.pending) && rw.pending[i].seq <= seq {
+		i++
+	}
+	rw.pending = rw.pending[i:]
+}
+
+// get packed data of unacknowledged messages to retransmit
+func (rw *reliableWindow) unacked() [][]byte {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	rw.prune(time.Now())
+	unacked := make([][]byte, 0, len(rw.pending))
+	for _, msg := range rw.pending {
+		unacked = append(unacked, msg.data)
+	}
+
+	return unacked
+}
+
+func (rw *reliableWindow) size() int {
+	rw.lock.Lock()
+	defer rw.lock.Unlock()
+
+	return len(rw.pending)
+}
+
+// discard messages beyond retention time
+func (rw *reliableWindow) prune(now time.Time) {
+	if config.Global.Reliable.RetentionTime <= 0 {
+		return
+	}
+
+	deadline := now.Add(-config.Global.Reliable.RetentionTime)
+	i := 0
+	for i < len(rw.pending) && rw.pending[i].sentAt.Before(deadline) {
+		i++
+	}
+	rw.pending = rw.pending[i:]
+}
+
+// SendReliable sends msg with a sequence number, it's kept until client acknowledges it and
+// retransmitted when the session is resumed
+func (c *connection) SendReliable(msg Message) (err error) {
+	if c.reliable == nil {
+		return ErrReliableDisabled
+	}
+
+	data, err := c.reliable.push(msg)
+	if err != nil {
+		return fmt.Errorf("connection [%d]: %w", c.ID, err)
+	}
+
+	if c.closed() {
+		// it's retransmitted on resuming
+		if c.session != nil {
+			return c.session.checkExpired()
+		}
+		return fmt.Errorf("connection [%d] has closed", c.ID)
+	}
+
+	return c.enqueue(&outMsg{data: data, priority: PriorityNormal})
+}
+
+func (c *connection) UnackedCount() int {
+	if c.reliable == nil {
+		return 0
+	}
+
+	return c.reliable.size()
+}
+
+// handleAck removes acknowledged messages from the reliable window
+func (c *connection) handleAck(msg Message) bool {
+	if c.reliable == nil || msg.GetDataType() != config.Global.Reliable.AckDataType {
+		return false
+	}
+
+	c.reliable.ack(msg.GetSeq())
+	return true
+}
+
+// retransmit sends unacknowledged messages again
+func (c *connection) retransmit() {
+	if c.reliable == nil {
+		return
+	}
+
+	for _, data := range c.reliable.unacked() {
+		if err := c.enqueue(&outMsg{data: data, priority: PriorityNormal}); err != nil {
+			c.Logger().Warn("failed to retransmit reliable message", zap.String("error", err.Error()))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/towerman1990/homey/config"
+)
+
+func TestReliableWindow(t *testing.T) {
+	config.Global.TLV.Seq = true
+	config.Global.Reliable.RetentionSize = 3
+	config.Global.Reliable.RetentionTime = time.Minute
+	defer func() {
+		config.Global.TLV.Seq = false
+		config.Global.Reliable.RetentionSize = 1024
+		config.Global.Reliable.RetentionTime = 5 * time.Minute
+	}()
+
+	rw := &reliableWindow{}
+	for i := 1; i <= 3; i++ {
+		msg := NewMessage(1, []byte("event"))
+		data, err := rw.push(msg)
+		if err != nil {
+			t.Fatalf("push message error: %v", err)
+		}
+
+		unpacked, err := UnPack(data, false)
+		if err != nil {
+			t.Fatalf("unpack message error: %v", err)
+		}
+		if unpacked.GetSeq() != uint32(i) || string(unpacked.GetData()) != "event" {
+			t.Errorf("expected seq %d, but %d got", i, unpacked.GetSeq())
+		}
+	}
+
+	if _, err := rw.push(NewMessage(1, nil)); err != ErrRetentionFull {
+		t.Errorf("expected %v, but %v got", ErrRetentionFull, err)
+	}
+
+	rw.ack(2)
+	if unacked := rw.unacked(); len(unacked) != 1 {
+		t.Errorf("expected 1 unacked message, but %d got", len(unacked))
+	}
+
+	// messages beyond retention time are discarded
+	rw.pending[0].sentAt = time.Now().Add(-2 * time.Minute)
+	if size := len(rw.unacked()); size != 0 {
+		t.Errorf("expected expired message discarded, but %d left", size)
+	}
+}
+
+func TestReliableRequirements(t *testing.T) {
+	reliable, session, tlv := config.Global.Reliable, config.Global.Session, config.Global.TLV
+	defer func() { config.Global.Reliable, config.Global.Session, config.Global.TLV = reliable, session, tlv }()
+
+	config.Global.Reliable.Status = true
+	config.Global.Session.Status, config.Global.Session.TokenDataType = true, 9
+	config.Global.TLV.Type, config.Global.TLV.Seq = false, true
+	config.Global.Reliable.AckDataType = 7
+	if newReliableWindow() != nil {
+		t.Error("expected reliable delivery disabled without tlv type")
+	}
+
+	config.Global.TLV.Type = true
+	config.Global.Reliable.AckDataType = 0
+	if newReliableWindow() != nil {
+		t.Error("expected reliable delivery disabled with ack data type 0")
+	}
+
+	config.Global.Reliable.AckDataType = 7
+	if newReliableWindow() == nil {
+		t.Error("expected reliable delivery enabled")
+	}
+
+	// unacknowledged messages would never be retransmitted without session
+	config.Global.Session.Status = false
+	if newReliableWindow() != nil {
+		t.Error("expected reliable delivery disabled without session")
+	}
+}
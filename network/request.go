@@ -1,5 +1,16 @@
 package network
 
+import (
+	"github.com/towerman1990/homey/config"
+)
+
+// values of message format
+const (
+	FormatText   = "text"
+	FormatBinary = "binary"
+	FormatMixed  = "mixed"
+)
+
 type (
 	Request interface {
 
@@ -11,6 +22,13 @@ type (
 
 		// get message data
 		GetMsgData() []byte
+
+		// get websocket frame type of the request, text or binary
+		GetFrameType() int
+
+		// send data back to the connection, it's in the same frame type as the request
+		// with mixed format, or the server's message type otherwise
+		Reply(data []byte) error
 	}
 
 	request struct {
@@ -20,6 +38,8 @@ type (
 
 		// request contains message
 		msg Message
+
+		frameType int
 	}
 )
 
@@ -34,3 +54,21 @@ func (r *request) GetMsgData() []byte {
 func (r *request) GetMsgDataType() uint32 {
 	return r.msg.GetDataType()
 }
+
+func (r *request) GetFrameType() int {
+	return r.frameType
+}
+
+func (r *request) Reply(data []byte) error {
+	return r.conn.SendMsgWithFrameType(data, replyFrameType(r.frameType))
+}
+
+// replyFrameType is the frame type of replies to a request of frameType,
+// 0 means the server's message type
+func replyFrameType(frameType int) int {
+	if config.Global.Message.Format != FormatMixed {
+		return 0
+	}
+
+	return frameType
+}
@@ -0,0 +1,228 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+)
+
+// policies applied when a connection's send queue is full
+const (
+	SendPolicyBlock      = "block"
+	SendPolicyDropNewest = "drop_newest"
+	SendPolicyDropOldest = "drop_oldest"
+	SendPolicyDisconnect = "disconnect"
+)
+
+// Priority selects the send queue lane of a message, the writer always drains
+// higher priority lanes first
+type Priority uint8
+
+const (
+	// heartbeat answers, resume tokens and other messages which shouldn't wait behind payloads
+	PriorityControl Priority = iota
+	PriorityNormal
+	PriorityBulk
+
+	priorityCount
+)
+
+// outMsg is an item of send queue
+type outMsg struct {
+	data []byte
+
+	priority Priority
+
+	// websocket frame type, 0 means the server's message type
+	frameType int
+
+	// dropped instead of waiting if the queue is full with block policy
+	noWait bool
+
+	// the message is discarded if ctx is done before writing
+	ctx context.Context
+
+	// called once the message is written or discarded
+	done func(error)
+}
+
+var (
+	ErrSendQueueFull = errors.New("send queue is full")
+
+	ErrSendTimeout = errors.New("send message timeout")
+)
+
+func (m *outMsg) finish(err error) {
+	if m.done != nil {
+		m.done(err)
+	}
+}
+
+// sendQueueSize returns capacity of each lane, it's at least 1, as drop oldest policy
+// would never find an oldest message to drop in an unbuffered lane
+func sendQueueSize() int {
+	if config.Global.Connection.SendQueueSize < 1 {
+		return 1
+	}
+
+	return config.Global.Connection.SendQueueSize
+}
+
+// enqueue puts msg into its lane of send queue, the slow consumer policy is applied if it's full
+func (c *connection) enqueue(msg *outMsg) (err error) {
+	if err = c.push(msg); err == nil && c.ctx.Err() != nil {
+		// the writer may have discarded the queue before msg was put into it
+		c.discardQueue()
+	}
+
+	return
+}
+
+func (c *connection) push(msg *outMsg) (err error) {
+	lane := c.sendLanes[msg.priority]
+	select {
+	case lane <- msg:
+		return
+	default:
+	}
+
+	switch config.Global.Connection.SendPolicy {
+	case SendPolicyDropNewest:
+		c.drop()
+		return fmt.Errorf("connection [%d]: %w", c.ID, ErrSendQueueFull)
+	case SendPolicyDropOldest:
+		for {
+			select {
+			case lane <- msg:
+				return
+			default:
+			}
+
+			select {
+			case oldest := <-lane:
+				c.drop()
+				oldest.finish(fmt.Errorf("connection [%d]: %w", c.ID, ErrSendQueueFull))
+			default:
+			}
+		}
+	case SendPolicyDisconnect:
+		c.drop()
+		c.Logger().Warn("disconnect slow consumer", zap.Int("queue size", cap(lane)))
+		go c.Kick("slow consumer")
+		return fmt.Errorf("connection [%d]: %w", c.ID, ErrSendQueueFull)
+	default:
+		if msg.noWait {
+			c.drop()
+			return fmt.Errorf("connection [%d]: %w", c.ID, ErrSendQueueFull)
+		}
+		return c.enqueueWithTimeout(msg, config.Global.Connection.SendTimeout)
+	}
+}
+
+func (c *connection) enqueueWithTimeout(msg *outMsg, timeout time.Duration) (err error) {
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	var ctxDone <-chan struct{}
+	if msg.ctx != nil {
+		ctxDone = msg.ctx.Done()
+	}
+
+	select {
+	case c.sendLanes[msg.priority] <- msg:
+		return
+	case <-ctxDone:
+		return msg.ctx.Err()
+	case <-timeoutChan:
+		c.drop()
+		return fmt.Errorf("connection [%d]: %w", c.ID, ErrSendTimeout)
+	case <-c.ctx.Done():
+		return fmt.Errorf("connection [%d] has closed", c.ID)
+	}
+}
+
+func (c *connection) drop() {
+	c.dropped.Add(1)
+	c.server.MessageCounter().IncDropped()
+}
+
+// poll takes the first pending message of lanes with higher priority than below
+func (c *connection) poll(below Priority) (*outMsg, bool) {
+	for priority := PriorityControl; priority < below; priority++ {
+		select {
+		case msg := <-c.sendLanes[priority]:
+			return msg, true
+		default:
+		}
+	}
+
+	return nil, false
+}
+
+// writeByPriority writes pending messages of higher priority lanes before msg
+func (c *connection) writeByPriority(msg *outMsg) error {
+	for {
+		higher, ok := c.poll(msg.priority)
+		if !ok {
+			break
+		}
+
+		if err := c.writeMsg(higher); err != nil {
+			msg.finish(err)
+			return err
+		}
+	}
+
+	return c.writeMsg(msg)
+}
+
+// flushQueue writes all pending messages before the close frame
+func (c *connection) flushQueue() {
+	for {
+		msg, ok := c.poll(priorityCount)
+		if !ok {
+			return
+		}
+
+		if err := c.writeMsg(msg); err != nil {
+			c.Logger().Warn("failed to flush message", zap.String("error", err.Error()))
+			return
+		}
+	}
+}
+
+// discardUntilDone finishes messages put into send queue after the close frame
+func (c *connection) discardUntilDone() {
+	for {
+		var msg *outMsg
+		select {
+		case msg = <-c.sendLanes[PriorityControl]:
+		case msg = <-c.sendLanes[PriorityNormal]:
+		case msg = <-c.sendLanes[PriorityBulk]:
+		case <-c.ctx.Done():
+			return
+		}
+
+		msg.finish(fmt.Errorf("connection [%d] has closed", c.ID))
+	}
+}
+
+// discardQueue finishes all messages left in send queue once the writer stopped
+func (c *connection) discardQueue() {
+	for {
+		msg, ok := c.poll(priorityCount)
+		if !ok {
+			return
+		}
+
+		msg.finish(fmt.Errorf("connection [%d] has closed", c.ID))
+	}
+}
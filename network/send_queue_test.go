@@ -0,0 +1,131 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/towerman1990/homey/config"
+)
+
+// a connection without websocket, each lane holds a single message
+func newQueueTestConnection() *connection {
+	c := &connection{
+		ID:             1,
+		server:         NewHomey(websocket.TextMessage, nil),
+		closeFrameChan: make(chan []byte, 1),
+		readerDone:     make(chan struct{}),
+	}
+	for priority := range c.sendLanes {
+		c.sendLanes[priority] = make(chan *outMsg, 1)
+	}
+	close(c.readerDone)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.bindLoggers()
+
+	return c
+}
+
+func TestSendPolicies(t *testing.T) {
+	policy, timeout := config.Global.Connection.SendPolicy, config.Global.Connection.SendTimeout
+	defer func() { config.Global.Connection.SendPolicy, config.Global.Connection.SendTimeout = policy, timeout }()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, test := range []struct {
+		policy string
+
+		// context of the message sent to the full lane
+		ctx context.Context
+
+		err error
+
+		// data left in the lane
+		queued string
+
+		// error the queued message is finished with
+		oldestErr error
+
+		dropped uint64
+	}{
+		{policy: SendPolicyDropNewest, err: ErrSendQueueFull, queued: "old", dropped: 1},
+		{policy: SendPolicyDropOldest, queued: "new", oldestErr: ErrSendQueueFull, dropped: 1},
+		{policy: SendPolicyDisconnect, err: ErrSendQueueFull, queued: "old", dropped: 1},
+		{policy: SendPolicyBlock, err: ErrSendTimeout, queued: "old", dropped: 1},
+		{policy: SendPolicyBlock, ctx: cancelled, err: context.Canceled, queued: "old"},
+	} {
+		config.Global.Connection.SendPolicy = test.policy
+		config.Global.Connection.SendTimeout = 20 * time.Millisecond
+
+		c := newQueueTestConnection()
+		var oldestErr error
+		c.sendLanes[PriorityNormal] <- &outMsg{data: []byte("old"), priority: PriorityNormal, done: func(err error) { oldestErr = err }}
+
+		err := c.enqueue(&outMsg{data: []byte("new"), priority: PriorityNormal, ctx: test.ctx})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v, but %v got", test.policy, test.err, err)
+		}
+
+		if msg, ok := c.poll(priorityCount); !ok || string(msg.data) != test.queued {
+			t.Errorf("%s: expected %s left in queue", test.policy, test.queued)
+		}
+
+		if !errors.Is(oldestErr, test.oldestErr) {
+			t.Errorf("%s: expected oldest message finished with %v, but %v got", test.policy, test.oldestErr, oldestErr)
+		}
+
+		if dropped := c.dropped.Load(); dropped != test.dropped {
+			t.Errorf("%s: expected %d dropped, but %d got", test.policy, test.dropped, dropped)
+		}
+		if dropped := c.server.MessageCounter().Dropped(); dropped != test.dropped {
+			t.Errorf("%s: expected %d dropped of server, but %d got", test.policy, test.dropped, dropped)
+		}
+
+		if test.policy == SendPolicyDisconnect {
+			deadline := time.Now().Add(time.Second)
+			for c.State() < StateClosing && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if c.State() < StateClosing {
+				t.Error("expected slow consumer disconnected")
+			}
+		}
+		c.cancel()
+	}
+}
+
+func TestEnqueueAfterWriterStopped(t *testing.T) {
+	c := newQueueTestConnection()
+	// the writer discarded the queue and stopped
+	c.cancel()
+	c.discardQueue()
+
+	done := make(chan error, 1)
+	if err := c.enqueue(&outMsg{data: []byte("late"), priority: PriorityNormal, done: func(err error) { done <- err }}); err != nil {
+		t.Fatalf("enqueue error: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected late message discarded with error")
+		}
+	default:
+		t.Error("expected callback of late message called")
+	}
+}
+
+func TestSendQueueSize(t *testing.T) {
+	size := config.Global.Connection.SendQueueSize
+	defer func() { config.Global.Connection.SendQueueSize = size }()
+
+	for _, test := range []struct{ configured, expected int }{{-1, 1}, {0, 1}, {1, 1}, {256, 256}} {
+		config.Global.Connection.SendQueueSize = test.configured
+		if got := sendQueueSize(); got != test.expected {
+			t.Errorf("expected send queue size %d of %d configured, but %d got", test.expected, test.configured, got)
+		}
+	}
+}
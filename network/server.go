@@ -3,11 +3,14 @@ package network
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/towerman1990/homey/config"
-	log "github.com/towerman1990/homey/logger"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -16,7 +19,10 @@ import (
 )
 
 var (
-	upgrader = websocket.Upgrader{}
+	upgrader = websocket.Upgrader{
+		Subprotocols:      config.Global.Connection.Subprotocols,
+		EnableCompression: config.Global.Compression.Status,
+	}
 )
 
 type (
@@ -30,6 +36,18 @@ type (
 
 		MessageHandler() MessageHandler
 
+		// get counter of received and sent messages
+		MessageCounter() *MessageCounter
+
+		// get the logger used by server and its connections
+		Logger() *zap.Logger
+
+		// get the sampled logger for per message logs
+		MessageLogger() *zap.Logger
+
+		// write an event into audit sink
+		Audit(AuditEvent)
+
 		// set a function it would be called on http request arrive
 		SetOnInit(func(context.Context))
 
@@ -47,24 +65,55 @@ type (
 
 		// call this function on connection closing
 		CallOnConnClose(Connection)
+
+		// add an observer which is called on state changes of every connection
+		OnStateChange(observer StateObserver)
+
+		// call state observers of server
+		CallOnStateChange(conn Connection, from, to ConnState)
 	}
 
 	Homey struct {
 		ctx context.Context
 
+		cancel context.CancelFunc
+
 		msgType int
 
+		// logger of network subsystem
+		logger *zap.Logger
+
+		msgLogger *zap.Logger
+
+		// logger of distribute subsystem
+		distLogger *zap.Logger
+
+		// runtime adjustable level of each subsystem
+		logLevels map[string]zap.AtomicLevel
+
+		auditSink AuditSink
+
+		sessions *sessionStore
+
 		ConnManager ConnectionManager
 
 		MsgHandler MessageHandler
 
-		RedirectMsgChan chan *[]byte
+		MsgCounter *MessageCounter
+
+		stats statsReporter
+
+		RedirectMsgChan chan []byte
 
 		OnInit func(context.Context)
 
 		OnConnOpen func(Connection) error
 
 		OnConnClose func(Connection)
+
+		stateObservers []StateObserver
+
+		stateLock sync.RWMutex
 	}
 )
 
@@ -84,6 +133,18 @@ func (h *Homey) MessageHandler() MessageHandler {
 	return h.MsgHandler
 }
 
+func (h *Homey) MessageCounter() *MessageCounter {
+	return h.MsgCounter
+}
+
+func (h *Homey) Logger() *zap.Logger {
+	return h.logger
+}
+
+func (h *Homey) MessageLogger() *zap.Logger {
+	return h.msgLogger
+}
+
 func (h *Homey) SetOnInit(hookFunc func(context.Context)) {
 	h.OnInit = hookFunc
 }
@@ -117,7 +178,14 @@ func (h *Homey) CallOnConnClose(conn Connection) {
 }
 
 func (h *Homey) Stop() {
+	h.cancel()
 	h.ConnManager.Clear()
+
+	if h.auditSink != nil {
+		if err := h.auditSink.Close(); err != nil {
+			h.logger.Error("failed to close audit sink", zap.String("error", err.Error()))
+		}
+	}
 }
 
 func (h *Homey) AddRouter(msgID uint32, router Router) {
@@ -132,10 +200,11 @@ func (h *Homey) SubscribeWorldChannel() {
 	for msg := range pubsub.Channel() {
 		data, err := base64.StdEncoding.DecodeString(msg.Payload)
 		if err != nil {
-			log.Logger.Error("failed to base64 decode message", zap.String("error", err.Error()))
+			h.distLogger.Error("failed to base64 decode message", zap.String("error", err.Error()))
+			continue
 		}
 
-		h.RedirectMsgChan <- &data
+		h.RedirectMsgChan <- data
 	}
 }
 
@@ -143,13 +212,14 @@ func (h *Homey) RedirectMsgHandler() {
 	for {
 		select {
 		case data := <-h.RedirectMsgChan:
-			msg, err := UnPack(*data, true)
+			msg, err := UnPack(data, true)
 			if err != nil {
-				log.Logger.Error("failed to unpack forward msg", zap.String("error", err.Error()))
+				h.distLogger.Error("failed to unpack forward msg", zap.String("error", err.Error()))
+				continue
 			}
 
 			if conn, err := h.ConnManager.Get(msg.GetConnID()); err == nil {
-				conn.SendMsg(*data)
+				conn.SendMsg(data)
 			}
 		}
 	}
@@ -157,40 +227,125 @@ func (h *Homey) RedirectMsgHandler() {
 
 func (h *Homey) Distribute() {
 	if !config.Global.Distribute.Status {
-		log.Logger.Error("distribute status is false, please set the value true and configurate redis")
+		h.distLogger.Error("distribute status is false, please set the value true and configurate redis")
+		os.Exit(1)
+	}
+
+	if err := distribute.Ping(h.ctx); err != nil {
+		h.distLogger.Error("failed to ping redis server", zap.String("error", err.Error()))
 		os.Exit(1)
 	}
 
 	go h.SubscribeWorldChannel()
+	go h.SubscribeNodeChannel()
 	go h.RedirectMsgHandler()
 }
 
+// RunAsLeader starts a leader election on key, onElected is called on the
+// only node holding the leadership and its context is cancelled on losing it,
+// the election is backed by redis if distribute status is true
+func (h *Homey) RunAsLeader(key string, onElected func(context.Context), onRevoked func()) *distribute.LeaderElector {
+	store := distribute.NewMemoryLeaseStore()
+	if config.Global.Distribute.Status {
+		store = distribute.NewRedisLeaseStore()
+	}
+
+	holder := fmt.Sprintf("%d-%d", utils.NodeID(), os.Getpid())
+	ttl := time.Duration(config.Global.Distribute.LeaderLease) * time.Second
+	elector := distribute.NewLeaderElector(store, key, holder, ttl, onElected, onRevoked)
+	elector.SetLogger(h.distLogger)
+	go elector.Run(h.ctx)
+
+	return elector
+}
+
 func (h *Homey) Echo() echo.HandlerFunc {
 	return func(c echo.Context) (err error) {
-		ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+		// the hijacked net.Conn is wrapped to count bytes on the wire
+		ws, err := upgrader.Upgrade(&countingResponseWriter{ResponseWriter: c.Response()}, c.Request(), nil)
 		if err != nil {
 			return err
 		}
 
-		id, err := utils.GenID()
-		if err != nil {
+		var s *session
+		if token := c.QueryParam(config.Global.Session.ResumeParam); sessionEnabled() && token != "" {
+			s = h.sessions.resume(token)
+		}
+		resumed := s != nil
+
+		var id uint64
+		if resumed {
+			id = s.connID
+		} else if id, err = utils.GenID(); err != nil {
+			ws.Close()
 			return err
 		}
 
-		conn := NewEchoConnection(id, h, ws)
+		// the session is created before the connection, so nothing has to be undone on failure
+		if s == nil && sessionEnabled() {
+			if s, err = h.sessions.create(id); err != nil {
+				ws.Close()
+				return err
+			}
+		}
+
+		conn := NewEchoConnection(id, h, ws, c.Request())
 		defer conn.Close()
+
+		h.bindSession(conn, s, resumed)
 		conn.Open()
 
 		return
 	}
 }
 
-func NewHomey(messageType int) *Homey {
+// per message logs would flood the sinks at high throughput, so they are sampled
+func newSampledLogger(logger *zap.Logger, sampling config.Sampling) *zap.Logger {
+	if sampling.Initial <= 0 || sampling.Tick <= 0 {
+		return logger
+	}
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, sampling.Tick, sampling.Initial, sampling.Thereafter)
+	}))
+}
+
+// NewHomey creates a server, all logs of it are written to logger,
+// pass nil or logger.Nop() to discard them
+func NewHomey(messageType int, logger *zap.Logger) *Homey {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	logLevels := newLogLevels(logger)
+	networkLogger := subsystemLogger(logger, LogNetwork, logLevels)
+
+	if config.Global.Connection.Heartbeat && !heartbeatEnabled() {
+		networkLogger.Warn("heartbeat is disabled, it requires tlv type enabled and a non-zero heartbeat data type")
+	}
+	if config.Global.Session.Status && !sessionEnabled() {
+		networkLogger.Warn("session is disabled, it requires tlv type enabled and a non-zero token data type")
+	}
+	if config.Global.RateLimit.Status && config.Global.RateLimit.Policy == RateLimitPolicyError && !rateLimitErrorEnabled() {
+		networkLogger.Warn("rate limit error policy drops messages without error, it requires tlv type enabled and a non-zero error data type")
+	}
+	if config.Global.Reliable.Status && !reliableEnabled() {
+		networkLogger.Warn("reliable delivery is disabled, it requires session and tlv seq enabled and a non-zero ack data type")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Homey{
-		ctx:             context.Background(),
+		ctx:             ctx,
+		cancel:          cancel,
 		msgType:         messageType,
-		ConnManager:     NewConnectionManager(),
-		MsgHandler:      NewMessageHandler(),
-		RedirectMsgChan: make(chan *[]byte),
+		logger:          networkLogger,
+		msgLogger:       newSampledLogger(networkLogger, config.Global.Log.Sampling),
+		distLogger:      subsystemLogger(logger, LogDistribute, logLevels),
+		logLevels:       logLevels,
+		ConnManager:     NewConnectionManager(networkLogger),
+		MsgHandler:      NewMessageHandler(subsystemLogger(logger, LogHandler, logLevels)),
+		MsgCounter:      &MessageCounter{},
+		sessions:        newSessionStore(),
+		RedirectMsgChan: make(chan []byte),
 	}
 }
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSampledLogger(t *testing.T) {
+	for _, test := range []struct {
+		sampling config.Sampling
+
+		// entries logged of 10 with the same message
+		expected int
+	}{
+		{sampling: config.Sampling{Initial: 2, Thereafter: 3, Tick: time.Minute}, expected: 4},
+		{sampling: config.Sampling{Initial: 10, Thereafter: 100, Tick: time.Minute}, expected: 10},
+		{sampling: config.Sampling{Initial: 0, Thereafter: 3, Tick: time.Minute}, expected: 10},
+		{sampling: config.Sampling{Initial: 2, Thereafter: 3}, expected: 10},
+	} {
+		core, logs := observer.New(zapcore.DebugLevel)
+		l := newSampledLogger(zap.New(core), test.sampling)
+		for i := 0; i < 10; i++ {
+			l.Debug("received message")
+		}
+
+		if logs.Len() != test.expected {
+			t.Errorf("expected %d entries with sampling %+v, but %d got", test.expected, test.sampling, logs.Len())
+		}
+	}
+}
+
+func TestNewHomeyLogger(t *testing.T) {
+	// nil discards logs
+	if h := NewHomey(websocket.TextMessage, nil); h.Logger() == nil || h.MessageLogger() == nil {
+		t.Fatal("expected loggers of server without logger")
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	h := NewHomey(websocket.TextMessage, zap.New(core))
+	h.Logger().Info("hello")
+	h.MessageHandler().(*messageHandler).logger.Info("hello")
+
+	entries := logs.TakeAll()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries written to injected logger, but %d got", len(entries))
+	}
+	for i, name := range []string{LogNetwork, LogHandler} {
+		if entries[i].LoggerName != name {
+			t.Errorf("expected entry of %s subsystem, but %s got", name, entries[i].LoggerName)
+		}
+	}
+}
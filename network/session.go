@@ -0,0 +1,299 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/towerman1990/homey/config"
+	"go.uber.org/zap"
+)
+
+type (
+	// session outlives its connection for a grace period, so a client could resume it
+	// on a new connection with the resume token
+	session struct {
+		token string
+
+		connID uint64
+
+		// the connection the session is bound to, nil while detached
+		conn *connection
+
+		// saved from the connection on detaching
+		userID string
+
+		startedAt time.Time
+
+		properties map[string]interface{}
+
+		// unacknowledged reliable messages, retransmitted on resuming
+		reliable *reliableWindow
+
+		// outbound messages sent while detached
+		buffer [][]byte
+
+		expireTimer *time.Timer
+
+		// set once the grace period passed without resuming
+		expired bool
+
+		store *sessionStore
+
+		lock sync.Mutex
+	}
+
+	sessionStore struct {
+		byToken map[string]*session
+
+		byConnID map[uint64]*session
+
+		lock sync.Mutex
+	}
+)
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		byToken:  make(map[string]*session),
+		byConnID: make(map[uint64]*session),
+	}
+}
+
+func newSessionToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// sessionEnabled tells whether the resume token could be told apart from application
+// messages by data type
+func sessionEnabled() bool {
+	return config.Global.Session.Status && config.Global.TLV.Type && config.Global.Session.TokenDataType != 0
+}
+
+// create adds a session of connID, messages are buffered until a connection is bound to it
+func (ss *sessionStore) create(connID uint64) (s *session, err error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return
+	}
+
+	s = &session{
+		token:  token,
+		connID: connID,
+		store:  ss,
+	}
+
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	ss.byToken[token] = s
+	ss.byConnID[connID] = s
+
+	return
+}
+
+// resume takes a detached session by token, nil if it doesn't exist or is in use
+func (ss *sessionStore) resume(token string) *session {
+	ss.lock.Lock()
+	s, ok := ss.byToken[token]
+	ss.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil || s.expireTimer == nil || !s.expireTimer.Stop() {
+		return nil
+	}
+	s.expireTimer = nil
+
+	return s
+}
+
+func (ss *sessionStore) getByConnID(connID uint64) *session {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	return ss.byConnID[connID]
+}
+
+func (ss *sessionStore) remove(s *session) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	delete(ss.byToken, s.token)
+	if ss.byConnID[s.connID] == s {
+		delete(ss.byConnID, s.connID)
+	}
+}
+
+// detach keeps state of the closed connection for the grace period
+func (s *session) detach(conn *connection) {
+	properties := make(map[string]interface{})
+	conn.RangeProperties(func(key string, value interface{}) bool {
+		properties[key] = value
+		return true
+	})
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.conn = nil
+	s.userID = conn.GetUserID()
+	s.startedAt = conn.startedAt
+	s.properties = properties
+	s.reliable = conn.reliable
+	s.expireTimer = time.AfterFunc(config.Global.Session.GracePeriod, func() {
+		s.lock.Lock()
+		s.expired = true
+		s.buffer = nil
+		s.lock.Unlock()
+
+		s.store.remove(s)
+	})
+}
+
+func (s *session) checkExpired() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.expired {
+		return fmt.Errorf("session of connection [%d] has expired", s.connID)
+	}
+
+	return nil
+}
+
+// send delivers data to the bound connection, or buffers it while detached or the
+// bound connection is closing, as the closing connection forwards its messages here
+func (s *session) send(data []byte) error {
+	s.lock.Lock()
+	if s.expired {
+		s.lock.Unlock()
+		return fmt.Errorf("session of connection [%d] has expired", s.connID)
+	}
+
+	conn := s.conn
+	if conn == nil || conn.closed() {
+		if len(s.buffer) >= config.Global.Session.BufferSize {
+			s.buffer = s.buffer[1:]
+		}
+		s.buffer = append(s.buffer, data)
+		s.lock.Unlock()
+		return nil
+	}
+	s.lock.Unlock()
+
+	// enqueue directly, so it never comes back to the session
+	return conn.enqueue(&outMsg{data: data, priority: PriorityNormal})
+}
+
+// isResumable tells whether a closed connection should keep its session,
+// connections closed on purpose or by policy have to start over
+func isResumable(closeCode int) bool {
+	switch closeCode {
+	case websocket.CloseNormalClosure, websocket.ClosePolicyViolation, CloseLifetimeExceeded:
+		return false
+	}
+
+	return true
+}
+
+// attachSession binds a resumed session to conn and restores its state
+func (c *connection) attachSession(s *session) {
+	s.lock.Lock()
+	s.conn = c
+	userID, properties, reliable := s.userID, s.properties, s.reliable
+	startedAt := s.startedAt
+	s.lock.Unlock()
+
+	c.session = s
+	// the user authenticated at the start, so max lifetime isn't reset by resuming
+	c.startedAt = startedAt
+	if reliable != nil {
+		c.reliable = reliable
+	}
+	for key, value := range properties {
+		c.properties[key] = value
+	}
+
+	if userID != "" {
+		c.userID.Store(userID)
+		c.bindLoggers(zap.String("user", userID))
+	}
+	c.resumed = true
+}
+
+// startSession sends resume token to client, then retransmits unacknowledged reliable messages
+// and replays messages buffered while detached
+func (c *connection) startSession() {
+	if c.session == nil {
+		return
+	}
+
+	data, err := Pack(NewMessage(config.Global.Session.TokenDataType, []byte(c.session.token)))
+	if err == nil {
+		err = c.SendMsgWithPriority(data, PriorityControl)
+	}
+
+	if err != nil {
+		c.Logger().Warn("failed to send resume token", zap.String("error", err.Error()))
+	}
+
+	c.retransmit()
+
+	c.session.lock.Lock()
+	buffer := c.session.buffer
+	c.session.buffer = nil
+	c.session.lock.Unlock()
+
+	for _, data := range buffer {
+		if err := c.SendMsg(data); err != nil {
+			c.Logger().Warn("failed to replay buffered message", zap.String("error", err.Error()))
+		}
+	}
+}
+
+func (c *connection) endSession() {
+	if c.session == nil {
+		return
+	}
+
+	if isResumable(c.CloseCode()) {
+		c.session.detach(c)
+		return
+	}
+
+	c.session.store.remove(c.session)
+}
+
+func (c *connection) IsResumed() bool {
+	return c.resumed
+}
+
+// bindSession binds s to conn, the state of a resumed session is restored
+func (h *Homey) bindSession(conn Connection, s *session, resumed bool) {
+	c, ok := conn.(*connection)
+	if !ok || s == nil {
+		return
+	}
+
+	if resumed {
+		c.attachSession(s)
+		return
+	}
+
+	s.lock.Lock()
+	s.conn = c
+	s.lock.Unlock()
+	c.session = s
+}
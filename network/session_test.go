@@ -0,0 +1,156 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/towerman1990/homey/config"
+)
+
+// enable sessions with a token data type until the test ends, it should be called
+// before any other cleanup is registered, so it's restored after connections closed
+func enableSession(t *testing.T) {
+	status, tlvType, dataType := config.Global.Session.Status, config.Global.TLV.Type, config.Global.Session.TokenDataType
+	config.Global.Session.Status, config.Global.TLV.Type, config.Global.Session.TokenDataType = true, true, 9
+	t.Cleanup(func() {
+		config.Global.Session.Status, config.Global.TLV.Type, config.Global.Session.TokenDataType = status, tlvType, dataType
+	})
+}
+
+func TestSessionResume(t *testing.T) {
+	enableSession(t)
+
+	h, url, opened := newTestServer(t)
+	conn, client := dialTestServer(t, websocket.DefaultDialer, url, opened)
+	conn.SetProperty("room", "lobby")
+
+	_, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("read token error: %v", err)
+	}
+	msg, err := UnPack(data, false)
+	if err != nil {
+		t.Fatalf("unpack token error: %v", err)
+	}
+	if msg.GetDataType() != 9 {
+		t.Errorf("expected token of data type 9, but %d got", msg.GetDataType())
+	}
+	token := string(msg.GetData())
+
+	// drop the connection without close handshake, then send while detached
+	client.UnderlyingConn().Close()
+	deadline := time.Now().Add(time.Second)
+	for h.ConnManager.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := h.sessions.getByConnID(conn.GetID()).send([]byte("missed")); err != nil {
+		t.Fatalf("buffer message error: %v", err)
+	}
+
+	resumed, client := dialTestServer(t, websocket.DefaultDialer, url+"?resume_token="+token, opened)
+	if !resumed.IsResumed() || resumed.GetID() != conn.GetID() {
+		t.Errorf("expected connection [%d] resumed", conn.GetID())
+	}
+	if room, _ := resumed.GetProperty("room"); room != "lobby" {
+		t.Errorf("expected property restored, but %v got", room)
+	}
+
+	for _, expected := range []string{token, "missed"} {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read message error: %v", err)
+		}
+
+		if !strings.HasSuffix(string(data), expected) {
+			t.Errorf("expected %s, but %s got", expected, data)
+		}
+	}
+
+	// a token can't be used twice
+	if h.sessions.resume(token) != nil {
+		t.Error("expected session in use not to be resumed")
+	}
+
+	client.Close()
+	for deadline := time.Now().Add(time.Second); resumed.State() != StateClosed && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSendOnConnClose(t *testing.T) {
+	enableSession(t)
+
+	h, url, opened := newTestServer(t)
+	sent := make(chan error, 1)
+	h.SetOnConnClose(func(conn Connection) {
+		sent <- conn.SendMsg([]byte("bye"))
+	})
+	conn, client := dialTestServer(t, websocket.DefaultDialer, url, opened)
+
+	// drop the connection without close handshake, so the session is kept
+	client.UnderlyingConn().Close()
+
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("expected message buffered, but %v got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose wasn't called")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for conn.State() != StateClosed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s := h.sessions.getByConnID(conn.GetID())
+	if s == nil {
+		t.Fatal("expected session kept")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.buffer) != 1 || string(s.buffer[0]) != "bye" {
+		t.Errorf("expected message buffered in session, but %q got", s.buffer)
+	}
+}
+
+func TestResumeKeepsLifetime(t *testing.T) {
+	startedAt := time.Now().Add(-time.Hour)
+	dropped := &connection{startedAt: startedAt, properties: make(map[string]interface{})}
+	s := &session{store: newSessionStore()}
+	s.detach(dropped)
+	s.expireTimer.Stop()
+
+	resumed := &connection{startedAt: time.Now(), properties: make(map[string]interface{})}
+	resumed.attachSession(s)
+	if !resumed.startedAt.Equal(startedAt) {
+		t.Errorf("expected lifetime started at %v, but %v got", startedAt, resumed.startedAt)
+	}
+}
+
+func TestSessionRequiresTokenDataType(t *testing.T) {
+	session, tlvType := config.Global.Session, config.Global.TLV.Type
+	defer func() { config.Global.Session, config.Global.TLV.Type = session, tlvType }()
+
+	config.Global.Session.Status = true
+	config.Global.TLV.Type = false
+	config.Global.Session.TokenDataType = 9
+	if sessionEnabled() {
+		t.Error("expected session disabled without tlv type")
+	}
+
+	config.Global.TLV.Type = true
+	config.Global.Session.TokenDataType = 0
+	if sessionEnabled() {
+		t.Error("expected session disabled with token data type 0")
+	}
+
+	config.Global.Session.TokenDataType = 9
+	if !sessionEnabled() {
+		t.Error("expected session enabled")
+	}
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// ConnState is the lifecycle state of a connection, it only moves forward
+type ConnState int32
+
+const (
+	// upgraded but OnConnOpen hasn't passed yet
+	StateConnecting ConnState = iota
+	StateOpen
+	// closing handshake started, or the connection is aborting
+	StateClosing
+	StateClosed
+)
+
+// StateObserver is called by the goroutine making the transition, so it must not block
+type StateObserver func(conn Connection, from, to ConnState)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	}
+
+	return fmt.Sprintf("unknown(%d)", int32(s))
+}
+
+func (c *connection) State() ConnState {
+	return ConnState(c.state.Load())
+}
+
+// closed tells whether the connection stopped accepting messages, nothing is written
+// after the close frame, so it's true since closing
+func (c *connection) closed() bool {
+	return c.State() >= StateClosing || c.ctx.Err() != nil
+}
+
+// advance moves the state forward to to, it's false if the state is already at or beyond to
+func (c *connection) advance(to ConnState) bool {
+	for {
+		from := c.State()
+		if from >= to {
+			return false
+		}
+
+		if c.state.CompareAndSwap(int32(from), int32(to)) {
+			c.notifyStateChange(from, to)
+			return true
+		}
+	}
+}
+
+func (c *connection) notifyStateChange(from, to ConnState) {
+	c.Logger().Debug("connection state changed", zap.Stringer("from", from), zap.Stringer("to", to))
+
+	c.stateLock.RLock()
+	observers := c.stateObservers
+	c.stateLock.RUnlock()
+
+	for _, observer := range observers {
+		observer(c, from, to)
+	}
+	c.server.CallOnStateChange(c, from, to)
+}
+
+func (c *connection) OnStateChange(observer StateObserver) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	// copy on write, so observers could be called without holding the lock
+	observers := make([]StateObserver, len(c.stateObservers), len(c.stateObservers)+1)
+	copy(observers, c.stateObservers)
+	c.stateObservers = append(observers, observer)
+}
+
+// OnStateChange adds an observer which is called on state changes of every connection
+func (h *Homey) OnStateChange(observer StateObserver) {
+	h.stateLock.Lock()
+	defer h.stateLock.Unlock()
+
+	observers := make([]StateObserver, len(h.stateObservers), len(h.stateObservers)+1)
+	copy(observers, h.stateObservers)
+	h.stateObservers = append(observers, observer)
+}
+
+func (h *Homey) CallOnStateChange(conn Connection, from, to ConnState) {
+	h.stateLock.RLock()
+	observers := h.stateObservers
+	h.stateLock.RUnlock()
+
+	for _, observer := range observers {
+		observer(conn, from, to)
+	}
+}
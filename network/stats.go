@@ -0,0 +1,267 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/towerman1990/homey/config"
+	"github.com/towerman1990/homey/distribute"
+	"github.com/towerman1990/homey/utils"
+	"go.uber.org/zap"
+)
+
+type (
+	// MessageCounter counts how many messages were received and sent by a node
+	MessageCounter struct {
+		in atomic.Uint64
+
+		out atomic.Uint64
+
+		dropped atomic.Uint64
+
+		// payload bytes of outbound messages
+		payloadOut atomic.Uint64
+
+		// bytes of outbound messages on the wire
+		wireOut atomic.Uint64
+	}
+
+	// NodeStats is a snapshot of a single node, it's published to the broker periodically
+	NodeStats struct {
+		NodeID uint16 `json:"node_id"`
+
+		// count of alive connections on the node
+		Connections int `json:"connections"`
+
+		// received messages per second
+		MsgInRate float64 `json:"msg_in_rate"`
+
+		// sent messages per second
+		MsgOutRate float64 `json:"msg_out_rate"`
+
+		// wire bytes divided by payload bytes of outbound messages, less is better
+		CompressionRatio float64 `json:"compression_ratio"`
+
+		// total outbound messages dropped by full send queues
+		MsgDropped uint64 `json:"msg_dropped"`
+
+		// waiting requests in each worker's task queue
+		QueueDepths []int `json:"queue_depths"`
+
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	// ClusterTotal is the sum of all nodes' statistics
+	ClusterTotal struct {
+		Nodes int `json:"nodes"`
+
+		Connections int `json:"connections"`
+
+		MsgInRate float64 `json:"msg_in_rate"`
+
+		MsgOutRate float64 `json:"msg_out_rate"`
+
+		MsgDropped uint64 `json:"msg_dropped"`
+
+		QueueDepth int `json:"queue_depth"`
+	}
+
+	ClusterStats struct {
+		Nodes []NodeStats `json:"nodes"`
+
+		Total ClusterTotal `json:"total"`
+	}
+
+	statsReporter struct {
+		lock sync.RWMutex
+
+		latest NodeStats
+
+		lastIn, lastOut uint64
+
+		lastTime time.Time
+	}
+)
+
+func (mc *MessageCounter) IncIn() {
+	mc.in.Add(1)
+}
+
+func (mc *MessageCounter) IncOut() {
+	mc.out.Add(1)
+}
+
+func (mc *MessageCounter) IncDropped() {
+	mc.dropped.Add(1)
+}
+
+// get total dropped outbound messages count
+func (mc *MessageCounter) Dropped() uint64 {
+	return mc.dropped.Load()
+}
+
+func (mc *MessageCounter) AddOutBytes(payloadBytes, wireBytes uint64) {
+	mc.payloadOut.Add(payloadBytes)
+	mc.wireOut.Add(wireBytes)
+}
+
+// get wire bytes divided by payload bytes of all outbound messages
+func (mc *MessageCounter) CompressionRatio() float64 {
+	payloadOut := mc.payloadOut.Load()
+	if payloadOut == 0 {
+		return 0
+	}
+
+	return float64(mc.wireOut.Load()) / float64(payloadOut)
+}
+
+// get total received and sent messages count
+func (mc *MessageCounter) Load() (in, out uint64) {
+	return mc.in.Load(), mc.out.Load()
+}
+
+func statsInterval() time.Duration {
+	if config.Global.Distribute.StatsInterval == 0 {
+		return 5 * time.Second
+	}
+
+	return time.Duration(config.Global.Distribute.StatsInterval) * time.Second
+}
+
+func (h *Homey) collectNodeStats() NodeStats {
+	h.stats.lock.Lock()
+	defer h.stats.lock.Unlock()
+
+	now := time.Now()
+	in, out := h.MsgCounter.Load()
+	stats := NodeStats{
+		NodeID:           utils.NodeID(),
+		Connections:      h.ConnManager.Count(),
+		MsgDropped:       h.MsgCounter.Dropped(),
+		CompressionRatio: h.MsgCounter.CompressionRatio(),
+		QueueDepths:      h.MsgHandler.GetTaskQueueDepths(),
+		UpdatedAt:        now,
+	}
+
+	if elapsed := now.Sub(h.stats.lastTime).Seconds(); !h.stats.lastTime.IsZero() && elapsed > 0 {
+		stats.MsgInRate = float64(in-h.stats.lastIn) / elapsed
+		stats.MsgOutRate = float64(out-h.stats.lastOut) / elapsed
+	}
+
+	h.stats.lastIn, h.stats.lastOut, h.stats.lastTime = in, out, now
+	h.stats.latest = stats
+
+	return stats
+}
+
+// StartStatsReporter collects statistics of current node periodically,
+// and publishes them to the broker if distribute status is true
+func (h *Homey) StartStatsReporter() {
+	ticker := time.NewTicker(statsInterval())
+	defer ticker.Stop()
+
+	nodeID := strconv.Itoa(int(utils.NodeID()))
+	h.collectNodeStats()
+
+	for {
+		select {
+		case <-ticker.C:
+			stats := h.collectNodeStats()
+			if !config.Global.Distribute.Status {
+				continue
+			}
+
+			data, err := json.Marshal(stats)
+			if err != nil {
+				h.distLogger.Error("failed to marshal node stats", zap.String("error", err.Error()))
+				continue
+			}
+
+			if err := distribute.ReportNodeStats(h.ctx, nodeID, data); err != nil {
+				h.distLogger.Error("failed to report node stats", zap.String("error", err.Error()))
+			}
+		case <-h.ctx.Done():
+			if config.Global.Distribute.Status {
+				if err := distribute.RemoveNodeStats(context.Background(), nodeID); err != nil {
+					h.distLogger.Error("failed to remove node stats", zap.String("error", err.Error()))
+				}
+			}
+			return
+		}
+	}
+}
+
+// ClusterStats returns statistics of every alive node and the total figures,
+// only current node is included if distribute status is false
+func (h *Homey) ClusterStats(ctx context.Context) (clusterStats ClusterStats, err error) {
+	if !config.Global.Distribute.Status {
+		h.stats.lock.RLock()
+		clusterStats.Nodes = []NodeStats{h.stats.latest}
+		h.stats.lock.RUnlock()
+		clusterStats.Total = sumNodeStats(clusterStats.Nodes)
+		return
+	}
+
+	values, err := distribute.GetNodeStats(ctx)
+	if err != nil {
+		return
+	}
+
+	// nodes which haven't reported for a while are considered dead
+	var dead []string
+	clusterStats.Nodes, dead = h.parseNodeStats(values, time.Now().Add(-3*statsInterval()))
+	clusterStats.Total = sumNodeStats(clusterStats.Nodes)
+
+	// dead nodes never remove their statistics, so they're removed here
+	for _, nodeID := range dead {
+		if err := distribute.RemoveNodeStats(ctx, nodeID); err != nil {
+			h.distLogger.Warn("failed to remove statistics of dead node", zap.String("node", nodeID), zap.String("error", err.Error()))
+		}
+	}
+
+	return
+}
+
+// parseNodeStats returns statistics of nodes which have reported since deadline in order of
+// node ID, and IDs of the other nodes
+func (h *Homey) parseNodeStats(values map[string]string, deadline time.Time) (nodes []NodeStats, dead []string) {
+	for nodeID, value := range values {
+		var stats NodeStats
+		if err := json.Unmarshal([]byte(value), &stats); err != nil {
+			h.distLogger.Warn("failed to unmarshal node stats", zap.String("error", err.Error()))
+			continue
+		}
+
+		if stats.UpdatedAt.Before(deadline) {
+			dead = append(dead, nodeID)
+			continue
+		}
+		nodes = append(nodes, stats)
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].NodeID < nodes[j].NodeID
+	})
+
+	return
+}
+
+func sumNodeStats(nodes []NodeStats) (total ClusterTotal) {
+	total.Nodes = len(nodes)
+	for _, node := range nodes {
+		total.Connections += node.Connections
+		total.MsgInRate += node.MsgInRate
+		total.MsgOutRate += node.MsgOutRate
+		total.MsgDropped += node.MsgDropped
+		for _, depth := range node.QueueDepths {
+			total.QueueDepth += depth
+		}
+	}
+
+	return
+}
@@ -0,0 +1,105 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCollectNodeStats(t *testing.T) {
+	h := NewHomey(websocket.TextMessage, nil)
+
+	if stats := h.collectNodeStats(); stats.MsgInRate != 0 || stats.MsgOutRate != 0 {
+		t.Errorf("expected no rate on first collection, but %f in and %f out got", stats.MsgInRate, stats.MsgOutRate)
+	}
+
+	for i := 0; i < 10; i++ {
+		h.MsgCounter.IncIn()
+	}
+	for i := 0; i < 4; i++ {
+		h.MsgCounter.IncOut()
+	}
+	h.MsgCounter.IncDropped()
+
+	// pretend the last collection was 2 seconds ago
+	h.stats.lastTime = h.stats.lastTime.Add(-2 * time.Second)
+	stats := h.collectNodeStats()
+	if math.Abs(stats.MsgInRate-5) > 0.1 || math.Abs(stats.MsgOutRate-2) > 0.1 {
+		t.Errorf("expected 5 in and 2 out per second, but %f and %f got", stats.MsgInRate, stats.MsgOutRate)
+	}
+	if stats.MsgDropped != 1 {
+		t.Errorf("expected 1 message dropped, but %d got", stats.MsgDropped)
+	}
+
+	// rates are measured since the last collection
+	h.stats.lastTime = h.stats.lastTime.Add(-time.Second)
+	if stats := h.collectNodeStats(); stats.MsgInRate != 0 || stats.MsgOutRate != 0 {
+		t.Errorf("expected no rate without new messages, but %f in and %f out got", stats.MsgInRate, stats.MsgOutRate)
+	}
+}
+
+func TestClusterStatsOfSingleNode(t *testing.T) {
+	h := NewHomey(websocket.TextMessage, nil)
+	h.MsgCounter.IncDropped()
+	latest := h.collectNodeStats()
+
+	clusterStats, err := h.ClusterStats(context.Background())
+	if err != nil {
+		t.Fatalf("get cluster stats error: %v", err)
+	}
+
+	if len(clusterStats.Nodes) != 1 || clusterStats.Nodes[0].NodeID != latest.NodeID || !clusterStats.Nodes[0].UpdatedAt.Equal(latest.UpdatedAt) {
+		t.Errorf("expected the latest stats of current node, but %+v got", clusterStats.Nodes)
+	}
+	if clusterStats.Total.Nodes != 1 || clusterStats.Total.MsgDropped != 1 {
+		t.Errorf("unexpected total of single node: %+v", clusterStats.Total)
+	}
+}
+
+func TestParseNodeStats(t *testing.T) {
+	h := NewHomey(websocket.TextMessage, nil)
+	now := time.Now()
+
+	values := make(map[string]string)
+	for nodeID, stats := range map[string]NodeStats{
+		"2": {NodeID: 2, UpdatedAt: now},
+		"1": {NodeID: 1, UpdatedAt: now.Add(-time.Second)},
+		"3": {NodeID: 3, UpdatedAt: now.Add(-time.Hour)},
+	} {
+		data, err := json.Marshal(stats)
+		if err != nil {
+			t.Fatalf("marshal node stats error: %v", err)
+		}
+		values[nodeID] = string(data)
+	}
+	values["4"] = "malformed"
+
+	nodes, dead := h.parseNodeStats(values, now.Add(-time.Minute))
+	if len(nodes) != 2 || nodes[0].NodeID != 1 || nodes[1].NodeID != 2 {
+		t.Errorf("expected alive nodes 1 and 2 in order, but %+v got", nodes)
+	}
+
+	if len(dead) != 1 || dead[0] != "3" {
+		t.Errorf("expected dead node 3, but %v got", dead)
+	}
+}
+
+func TestSumNodeStats(t *testing.T) {
+	total := sumNodeStats([]NodeStats{
+		{Connections: 3, MsgInRate: 1.5, MsgOutRate: 2, MsgDropped: 1, QueueDepths: []int{1, 2}},
+		{Connections: 4, MsgInRate: 0.5, MsgOutRate: 1, MsgDropped: 2, QueueDepths: []int{3}},
+	})
+
+	expected := ClusterTotal{Nodes: 2, Connections: 7, MsgInRate: 2, MsgOutRate: 3, MsgDropped: 3, QueueDepth: 6}
+	if total != expected {
+		t.Errorf("expected %+v, but %+v got", expected, total)
+	}
+
+	if total := sumNodeStats(nil); total != (ClusterTotal{}) {
+		t.Errorf("expected zero total of no nodes, but %+v got", total)
+	}
+}
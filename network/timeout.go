@@ -0,0 +1,45 @@
+package network
+
+import (
+	"time"
+)
+
+// watchTimeouts closes the connection once it's idle or beyond max lifetime,
+// a resumed connection doesn't get a fresh lifetime
+func (c *connection) watchTimeouts() {
+	idleTimeout, maxLifetime := c.idleTimeout, c.maxLifetime
+	if idleTimeout <= 0 && maxLifetime <= 0 {
+		return
+	}
+
+	var idleChan, lifetimeChan <-chan time.Time
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idleChan = idleTimer.C
+	}
+
+	if maxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(maxLifetime - time.Since(c.startedAt))
+		defer lifetimeTimer.Stop()
+		lifetimeChan = lifetimeTimer.C
+	}
+
+	for {
+		select {
+		case <-idleChan:
+			idle := time.Since(time.Unix(0, c.lastActivity.Load()))
+			if idle >= idleTimeout {
+				c.CloseWithReason(CloseIdleTimeout, "idle timeout")
+				return
+			}
+			idleTimer.Reset(idleTimeout - idle)
+		case <-lifetimeChan:
+			c.CloseWithReason(CloseLifetimeExceeded, "max lifetime exceeded")
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
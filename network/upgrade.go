@@ -0,0 +1,107 @@
+package network
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/towerman1990/homey/config"
+)
+
+var (
+	trustedProxies     []*net.IPNet
+	trustedProxiesOnce sync.Once
+)
+
+func parseTrustedProxies() {
+	for _, proxy := range config.Global.Connection.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+
+		if _, ipNet, err := net.ParseCIDR(proxy); err == nil {
+			trustedProxies = append(trustedProxies, ipNet)
+		}
+	}
+}
+
+func isTrustedProxy(ip string) bool {
+	trustedProxiesOnce.Do(parseTrustedProxies)
+
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP walks X-Forwarded-For from right to left while the hops are trusted proxies,
+// the first untrusted hop is the client
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func (c *connection) RemoteAddr() string {
+	return c.remoteAddr
+}
+
+func (c *connection) Header() http.Header {
+	return c.header
+}
+
+func (c *connection) Query() url.Values {
+	return c.query
+}
+
+func (c *connection) Cookie(name string) (*http.Cookie, error) {
+	r := http.Request{Header: c.header}
+	return r.Cookie(name)
+}
+
+func (c *connection) Subprotocol() string {
+	return c.subprotocol
+}
+
+func (c *connection) TLS() *tls.ConnectionState {
+	return c.tlsState
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/towerman1990/homey/config"
+)
+
+func TestClientIP(t *testing.T) {
+	// make sure the proxies won't be parsed again lazily
+	trustedProxiesOnce.Do(func() {})
+	trustedProxies = nil
+	config.Global.Connection.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	parseTrustedProxies()
+	defer func() {
+		config.Global.Connection.TrustedProxies = nil
+		trustedProxies = nil
+	}()
+
+	cases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expectedIP   string
+	}{
+		{"1.2.3.4:5678", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:5678", "", "10.0.0.1"},
+		{"10.0.0.1:5678", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:5678", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = c.remoteAddr
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+
+		if ip := clientIP(r); ip != c.expectedIP {
+			t.Errorf("expected client IP %s, but %s got", c.expectedIP, ip)
+		}
+	}
+}
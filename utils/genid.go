@@ -4,6 +4,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sony/sonyflake"
@@ -42,6 +43,26 @@ func getMachineID() (machineID uint16, err error) {
 	return
 }
 
+var (
+	nodeID     uint16
+	nodeIDOnce sync.Once
+)
+
+// NodeID returns the machine ID of current node, it's the same value
+// which is embedded into every ID generated by GenID
+func NodeID() uint16 {
+	nodeIDOnce.Do(func() {
+		nodeID, _ = getMachineID()
+	})
+
+	return nodeID
+}
+
+// NodeIDOf returns the machine ID of the node which generated id
+func NodeIDOf(id uint64) uint16 {
+	return uint16(sonyflake.MachineID(id))
+}
+
 func saddMachineIDToRedisSet() (result int, err error) {
 	return
 }